@@ -0,0 +1,236 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// UserAccountControl is the userAccountControl bit mask of a user
+type UserAccountControl uint32
+
+const (
+	AccountDisabled                   UserAccountControl = AC_ACCOUNTDISABLE
+	AccountLockedOut                  UserAccountControl = AC_LOCKOUT
+	AccountPasswordNotRequired        UserAccountControl = AC_PASSWD_NOTREQD
+	AccountPasswordCantChange         UserAccountControl = AC_PASSWD_CANT_CHANGE
+	AccountNormal                     UserAccountControl = AC_NORMAL_ACCOUNT
+	AccountPasswordNeverExpires       UserAccountControl = AC_DONT_EXPIRE_PASSWORD
+	AccountSmartcardRequired          UserAccountControl = AC_SMARTCARD_REQUIRED
+	AccountTrustedForDelegation       UserAccountControl = AC_TRUSTED_FOR_DELEGATION
+	AccountNotDelegated               UserAccountControl = AC_NOT_DELEGATED
+	AccountDontRequirePreauth         UserAccountControl = AC_DONT_REQ_PREAUTH
+	AccountPasswordExpired            UserAccountControl = AC_PASSWORD_EXPIRED
+	AccountTrustedToAuthForDelegation UserAccountControl = AC_TRUSTED_TO_AUTH_FOR_DELEGATION
+)
+
+var accountFlagNames = []struct {
+	flag UserAccountControl
+	name string
+}{
+	{AC_SCRIPT, "script"},
+	{AC_ACCOUNTDISABLE, "disabled"},
+	{AC_HOMEDIR_REQUIRED, "homedir-required"},
+	{AC_LOCKOUT, "locked-out"},
+	{AC_PASSWD_NOTREQD, "password-not-required"},
+	{AC_PASSWD_CANT_CHANGE, "password-cant-change"},
+	{AC_ENCRYPTED_TEXT_PWD_ALLOWED, "encrypted-text-password-allowed"},
+	{AC_TEMP_DUPLICATE_ACCOUNT, "temp-duplicate-account"},
+	{AC_NORMAL_ACCOUNT, "normal-account"},
+	{AC_INTERDOMAIN_TRUST_ACCOUNT, "interdomain-trust-account"},
+	{AC_WORKSTATION_TRUST_ACCOUNT, "workstation-trust-account"},
+	{AC_SERVER_TRUST_ACCOUNT, "server-trust-account"},
+	{AC_DONT_EXPIRE_PASSWORD, "password-never-expires"},
+	{AC_MNS_LOGON_ACCOUNT, "mns-logon-account"},
+	{AC_SMARTCARD_REQUIRED, "smartcard-required"},
+	{AC_TRUSTED_FOR_DELEGATION, "trusted-for-delegation"},
+	{AC_NOT_DELEGATED, "not-delegated"},
+	{AC_USE_DES_KEY_ONLY, "use-des-key-only"},
+	{AC_DONT_REQ_PREAUTH, "dont-require-preauth"},
+	{AC_PASSWORD_EXPIRED, "password-expired"},
+	{AC_TRUSTED_TO_AUTH_FOR_DELEGATION, "trusted-to-auth-for-delegation"},
+	{AC_PARTIAL_SECRETS_ACCOUNT, "partial-secrets-account"},
+}
+
+// fixedAccountFlags can not be changed through SetAccountFlags and
+// ClearAccountFlags. The account type bits are set when the object is
+// created, lockout and password expired are computed by AD.
+const fixedAccountFlags = UserAccountControl(AC_TEMP_DUPLICATE_ACCOUNT | AC_NORMAL_ACCOUNT | AC_INTERDOMAIN_TRUST_ACCOUNT |
+	AC_WORKSTATION_TRUST_ACCOUNT | AC_SERVER_TRUST_ACCOUNT | AC_PARTIAL_SECRETS_ACCOUNT | AC_LOCKOUT | AC_PASSWORD_EXPIRED)
+
+// ParseAccountFlags parses a comma separated list of flag names as returned
+// by String, e.g. "password-never-expires,smartcard-required"
+func ParseAccountFlags(s string) (UserAccountControl, error) {
+	var uac UserAccountControl
+	for _, part := range strings.Split(s, ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, f := range accountFlagNames {
+			if f.name == name {
+				uac |= f.flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("invalid account flag %v", part)
+		}
+	}
+	return uac, nil
+}
+
+// Has reports if all the given flags are set
+func (uac UserAccountControl) Has(flags UserAccountControl) bool {
+	return uac&flags == flags
+}
+
+func (uac UserAccountControl) Disabled() bool {
+	return uac.Has(AccountDisabled)
+}
+
+func (uac UserAccountControl) LockedOut() bool {
+	return uac.Has(AccountLockedOut)
+}
+
+func (uac UserAccountControl) PasswordNotRequired() bool {
+	return uac.Has(AccountPasswordNotRequired)
+}
+
+func (uac UserAccountControl) PasswordCantChange() bool {
+	return uac.Has(AccountPasswordCantChange)
+}
+
+func (uac UserAccountControl) PasswordNeverExpires() bool {
+	return uac.Has(AccountPasswordNeverExpires)
+}
+
+func (uac UserAccountControl) PasswordExpired() bool {
+	return uac.Has(AccountPasswordExpired)
+}
+
+func (uac UserAccountControl) SmartcardRequired() bool {
+	return uac.Has(AccountSmartcardRequired)
+}
+
+func (uac UserAccountControl) TrustedForDelegation() bool {
+	return uac.Has(AccountTrustedForDelegation)
+}
+
+func (uac UserAccountControl) NotDelegated() bool {
+	return uac.Has(AccountNotDelegated)
+}
+
+func (uac UserAccountControl) DontRequirePreauth() bool {
+	return uac.Has(AccountDontRequirePreauth)
+}
+
+// String lists the names of the flags that are set, separated by commas.
+// Bits without a name are added in hex.
+func (uac UserAccountControl) String() string {
+	var names []string
+	rest := uac
+	for _, f := range accountFlagNames {
+		if uac.Has(f.flag) {
+			names = append(names, f.name)
+			rest &^= f.flag
+		}
+	}
+	if rest != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(rest)))
+	}
+	return strings.Join(names, ",")
+}
+
+// GetAccountFlags returns the userAccountControl flags of a user, including
+// the lockout and password expired flags that AD computes
+func (um *AdUserManager) GetAccountFlags(ctx context.Context, uid string) (UserAccountControl, error) {
+	entry, err := um.dir.userEntry(ctx, uid, []string{USER_ACCOUNT_CONTROL_TYPE, UAC_COMPUTED_TYPE})
+	if err != nil {
+		return 0, err
+	}
+	if entry == nil {
+		return 0, fmt.Errorf("user not found %v", uid)
+	}
+	return entryAccountControl(entry)
+}
+
+// SetAccountFlags sets the given flags, the other flags are left as they are
+func (um *AdUserManager) SetAccountFlags(ctx context.Context, uid string, flags UserAccountControl) error {
+	if flags&fixedAccountFlags != 0 {
+		return fmt.Errorf("account flags %v can not be set", flags&fixedAccountFlags)
+	}
+	return um.updateAccountControl(ctx, uid, func(uac uint32) uint32 {
+		return uac | uint32(flags)
+	})
+}
+
+// ClearAccountFlags clears the given flags, the other flags are left as they
+// are
+func (um *AdUserManager) ClearAccountFlags(ctx context.Context, uid string, flags UserAccountControl) error {
+	if flags&fixedAccountFlags != 0 {
+		return fmt.Errorf("account flags %v can not be cleared", flags&fixedAccountFlags)
+	}
+	return um.updateAccountControl(ctx, uid, func(uac uint32) uint32 {
+		return uac &^ uint32(flags)
+	})
+}
+
+// entryAccountControl combines userAccountControl with its computed flags
+func entryAccountControl(entry *ldap.Entry) (UserAccountControl, error) {
+	val := entry.GetEqualFoldAttributeValue(USER_ACCOUNT_CONTROL_TYPE)
+	uac, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %v on %v", USER_ACCOUNT_CONTROL_TYPE, val, entry.DN)
+	}
+
+	computed, _ := strconv.ParseInt(entry.GetEqualFoldAttributeValue(UAC_COMPUTED_TYPE), 10, 64)
+	return UserAccountControl(uac) | UserAccountControl(computed), nil
+}
+
+// UAC_UPDATE_ATTEMPTS is the number of times a userAccountControl update is
+// retried when the value changes underneath it
+const UAC_UPDATE_ATTEMPTS = 5
+
+// updateAccountControl changes userAccountControl with a read-modify-write.
+// The old value is deleted and the new one added in the same request, AD
+// rejects the request when the old value is no longer there so a concurrent
+// change is never overwritten. The update is then retried on the new value.
+func (um *AdUserManager) updateAccountControl(ctx context.Context, uid string, update func(uac uint32) uint32) error {
+	for attempt := 0; attempt < UAC_UPDATE_ATTEMPTS; attempt++ {
+		entry, err := um.dir.userEntry(ctx, uid, []string{USER_ACCOUNT_CONTROL_TYPE})
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("user not found %v", uid)
+		}
+
+		old := entry.GetEqualFoldAttributeValue(USER_ACCOUNT_CONTROL_TYPE)
+		current, err := strconv.ParseInt(old, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %v %v on %v", USER_ACCOUNT_CONTROL_TYPE, old, uid)
+		}
+
+		next := update(uint32(current))
+		if next == uint32(current) {
+			return nil
+		}
+
+		req := ldap.NewModifyRequest(entry.DN, nil)
+		req.Delete(USER_ACCOUNT_CONTROL_TYPE, []string{old})
+		req.Add(USER_ACCOUNT_CONTROL_TYPE, []string{strconv.FormatInt(int64(int32(next)), 10)})
+		err = um.dir.modify(ctx, req)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("%v of %v changed during %d update attempts", USER_ACCOUNT_CONTROL_TYPE, uid, UAC_UPDATE_ATTEMPTS)
+}
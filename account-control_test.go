@@ -0,0 +1,31 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserAccountControlString(t *testing.T) {
+	uac := AccountNormal | AccountPasswordNeverExpires | AccountDisabled
+	assert.Equal(t, uac.String(), "disabled,normal-account,password-never-expires")
+	assert.True(t, uac.Disabled())
+	assert.True(t, uac.PasswordNeverExpires())
+	assert.False(t, uac.SmartcardRequired())
+
+	assert.Equal(t, UserAccountControl(0).String(), "")
+	assert.Equal(t, (AccountNormal | 0x4).String(), "normal-account,0x4")
+}
+
+func TestParseAccountFlags(t *testing.T) {
+	uac, err := ParseAccountFlags("smartcard-required, Not-Delegated")
+	assert.Nil(t, err)
+	assert.Equal(t, uac, AccountSmartcardRequired|AccountNotDelegated)
+
+	uac, err = ParseAccountFlags((AccountNormal | AccountDontRequirePreauth).String())
+	assert.Nil(t, err)
+	assert.Equal(t, uac, AccountNormal|AccountDontRequirePreauth)
+
+	_, err = ParseAccountFlags("password-never-expires,bogus")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,48 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/appliedres/cloudy-ad/adtime"
+	"github.com/appliedres/cloudy/models"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// SetAccountExpiry sets the time at which a user can no longer sign in
+func (um *AdUserManager) SetAccountExpiry(ctx context.Context, uid string, expires time.Time) error {
+	if expires.IsZero() {
+		return fmt.Errorf("invalid account expiry for %v, use ClearAccountExpiry for accounts that never expire", uid)
+	}
+	return um.setAccountExpires(ctx, uid, adtime.ToFileTime(expires))
+}
+
+// ClearAccountExpiry makes a user account never expire
+func (um *AdUserManager) ClearAccountExpiry(ctx context.Context, uid string) error {
+	return um.setAccountExpires(ctx, uid, AC_ACCOUNT_NEVER_EXPIRES)
+}
+
+func (um *AdUserManager) setAccountExpires(ctx context.Context, uid string, val int64) error {
+	entry, err := um.dir.userEntry(ctx, uid, []string{ACCT_EXPIRES_TYPE})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Replace(ACCT_EXPIRES_TYPE, []string{strconv.FormatInt(val, 10)})
+	return um.dir.modify(ctx, req)
+}
+
+// ListExpiringUsers returns the users whose accounts expire within the given
+// window from now. Accounts that have already expired are not included.
+func (um *AdUserManager) ListExpiringUsers(ctx context.Context, within time.Duration) (*[]models.User, error) {
+	now := time.Now()
+	filter := fmt.Sprintf("(&(objectClass=user)(objectCategory=person)(%v>=%d)(%v<=%d))",
+		ACCT_EXPIRES_TYPE, adtime.ToFileTime(now), ACCT_EXPIRES_TYPE, adtime.ToFileTime(now.Add(within)))
+	return um.ListUsers(ctx, filter, nil)
+}
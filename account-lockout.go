@@ -0,0 +1,70 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/appliedres/cloudy-ad/adtime"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LockoutStatus is the lockout state of a user. The bad password count and
+// time are those of the domain controller that answered.
+type LockoutStatus struct {
+	Locked           bool
+	LockoutTime      time.Time
+	BadPasswordCount int
+	BadPasswordTime  time.Time
+}
+
+// GetLockoutStatus returns the lockout state of a user
+func (um *AdUserManager) GetLockoutStatus(ctx context.Context, uid string) (*LockoutStatus, error) {
+	entry, err := um.dir.userEntry(ctx, uid, []string{UAC_COMPUTED_TYPE, LOCKOUT_TIME_TYPE, BAD_PWD_COUNT_TYPE, BAD_PASSWORD_TIME_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("user not found %v", uid)
+	}
+
+	count, _ := strconv.Atoi(entry.GetEqualFoldAttributeValue(BAD_PWD_COUNT_TYPE))
+	lockoutTime, _ := adtime.ParseFileTime(entry.GetEqualFoldAttributeValue(LOCKOUT_TIME_TYPE))
+	badPasswordTime, _ := adtime.ParseFileTime(entry.GetEqualFoldAttributeValue(BAD_PASSWORD_TIME_TYPE))
+	return &LockoutStatus{
+		Locked:           lockedOut(entry.GetEqualFoldAttributeValue(UAC_COMPUTED_TYPE), entry.GetEqualFoldAttributeValue(LOCKOUT_TIME_TYPE)),
+		LockoutTime:      lockoutTime,
+		BadPasswordCount: count,
+		BadPasswordTime:  badPasswordTime,
+	}, nil
+}
+
+// UnlockUser clears a lockout. Setting lockoutTime to 0 is the only write AD
+// allows on it and also resets the bad password count.
+func (um *AdUserManager) UnlockUser(ctx context.Context, uid string) error {
+	entry, err := um.dir.userEntry(ctx, uid, []string{LOCKOUT_TIME_TYPE})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Replace(LOCKOUT_TIME_TYPE, []string{"0"})
+	return um.dir.modify(ctx, req)
+}
+
+// lockedOut works out the lockout state from the computed account control
+// flags, AD does not maintain the lockout bit in userAccountControl. When the
+// flags were not read a set lockoutTime is taken as locked.
+func lockedOut(computed string, lockoutTime string) bool {
+	if computed != "" {
+		flags, err := strconv.ParseInt(computed, 10, 64)
+		return err == nil && flags&AC_LOCKOUT != 0
+	}
+
+	t, err := strconv.ParseInt(lockoutTime, 10, 64)
+	return err == nil && t > 0
+}
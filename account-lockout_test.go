@@ -0,0 +1,15 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockedOut(t *testing.T) {
+	assert.True(t, lockedOut("16", "0"))
+	assert.False(t, lockedOut("0", "133000000000000000"))
+	assert.True(t, lockedOut("", "133000000000000000"))
+	assert.False(t, lockedOut("", "0"))
+	assert.False(t, lockedOut("", ""))
+}
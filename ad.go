@@ -31,6 +31,12 @@ const (
 	ADS_GROUP_TYPE_SECURITY_ENABLED   = 0x80000000 // Specifies a group that is security enabled. This group can be used to apply an access-control list on an ADSI object or a file system.
 )
 
+const (
+	ADS_GROUP_TYPE_BUILTIN_LOCAL_GROUP = 0x00000001 // Specifies a group that is created by the system.
+	ADS_GROUP_TYPE_GLOBAL_GROUP        = 0x00000002 // Specifies a group that can contain accounts from the same domain and other global groups from the same domain.
+	ADS_GROUP_TYPE_UNIVERSAL_GROUP     = 0x00000008 // Specifies a group that can contain accounts from any domain, global groups from any domain, and other universal groups.
+)
+
 // 0 means use default in client
 const TICKER_DURATION = 0
 const MAX_ATTEMPTS = 0
@@ -49,18 +55,75 @@ const OBJ_CLASS_TYPE = "objectClass"
 const INSTANCE_TYPE = "instanceType"
 const SAM_ACCT_NAME_TYPE = "sAMAccountName"
 const PASSWORD_LAST_SET = "pwdLastSet"
+const MEMBER_TYPE = "member"
+const MEMBER_OF_TYPE = "memberOf"
+const DN_TYPE = "distinguishedName"
+const OBJECT_SID_TYPE = "objectSid"
+const PRIMARY_GROUP_ID_TYPE = "primaryGroupID"
+const UAC_COMPUTED_TYPE = "msDS-User-Account-Control-Computed"
+const ACCOUNT_FLAGS_TYPE = "accountFlags"
+const LOCKOUT_TIME_TYPE = "lockoutTime"
+const BAD_PWD_COUNT_TYPE = "badPwdCount"
+const BAD_PASSWORD_TIME_TYPE = "badPasswordTime"
+const LOCKED_OUT_TYPE = "lockedOut"
+const LAST_LOGON_TIMESTAMP_TYPE = "lastLogonTimestamp"
+const PASSWORD_MUST_CHANGE_TYPE = "passwordMustChange"
+const LAST_SIGN_IN_TYPE = "lastSignIn"
+const LAST_SIGN_IN_SOURCE_TYPE = "lastSignInSource"
+const LAST_SIGN_IN_PRECISION_TYPE = "lastSignInPrecision"
+const LAST_SIGN_IN_ERROR_TYPE = "lastSignInError"
+const UNICODE_PWD_TYPE = "unicodePwd"
 
 const GROUP_NAME_TYPE = "name"
 const GROUP_TYPE = "groupType"
 const GROUP_COMMON_NAME = "cn"
+const GROUP_DESCRIPTION_TYPE = "description"
+const GROUP_MAIL_TYPE = "mail"
+const GROUP_MANAGED_BY_TYPE = "managedBy"
+const GROUP_INFO_TYPE = "info"
+const GROUP_ADMIN_DESCRIPTION_TYPE = "adminDescription"
+const WHEN_CREATED_TYPE = "whenCreated"
+const WHEN_CHANGED_TYPE = "whenChanged"
 const GROUP_SOURCE = "Active Directory"
 
 var USER_OBJ_CLASS_VALS = []string{"top", "organizationalPerson", "user", "person"}
 var GROUP_OBJ_CLASS_VALS = []string{"top", "group"}
 
-var USER_STANDARD_ATTRS = []string{FIRST_NAME_TYPE, LAST_NAME_TYPE, EMAIL_TYPE, DISPLAY_NAME_TYPE, LAST_LOGIN_TYPE, USERNAME_TYPE, USER_ACCOUNT_CONTROL_TYPE, USER_PRINCIPAL_NAME_TYPE}
-var USER_OBJECT_ATTRS = []string{FIRST_NAME_TYPE, LAST_NAME_TYPE, EMAIL_TYPE, DISPLAY_NAME_TYPE, USERNAME_TYPE, USER_ACCOUNT_CONTROL_TYPE}
-var GROUP_STANDARD_ATTRS = []string{GROUP_NAME_TYPE, GROUP_TYPE, GROUP_COMMON_NAME}
+var USER_STANDARD_ATTRS = []string{FIRST_NAME_TYPE, LAST_NAME_TYPE, EMAIL_TYPE, DISPLAY_NAME_TYPE, LAST_LOGIN_TYPE, USERNAME_TYPE, USER_ACCOUNT_CONTROL_TYPE, USER_PRINCIPAL_NAME_TYPE, UAC_COMPUTED_TYPE, LOCKOUT_TIME_TYPE, BAD_PWD_COUNT_TYPE, BAD_PASSWORD_TIME_TYPE, ACCT_EXPIRES_TYPE, PASSWORD_LAST_SET, LAST_LOGON_TIMESTAMP_TYPE, WHEN_CREATED_TYPE, WHEN_CHANGED_TYPE}
+var USER_OBJECT_ATTRS = []string{FIRST_NAME_TYPE, LAST_NAME_TYPE, EMAIL_TYPE, DISPLAY_NAME_TYPE, USERNAME_TYPE, USER_ACCOUNT_CONTROL_TYPE, UAC_COMPUTED_TYPE}
+
+// USER_COMPUTED_ATTRS are returned on users but are worked out by AD or by
+// the manager and are never written back in UpdateUser
+var USER_COMPUTED_ATTRS = []string{UAC_COMPUTED_TYPE, ACCOUNT_FLAGS_TYPE, LOCKOUT_TIME_TYPE, BAD_PWD_COUNT_TYPE, BAD_PASSWORD_TIME_TYPE, LOCKED_OUT_TYPE, ACCT_EXPIRES_TYPE,
+	LAST_LOGIN_TYPE, LAST_LOGON_TIMESTAMP_TYPE, PASSWORD_LAST_SET, PASSWORD_MUST_CHANGE_TYPE, WHEN_CREATED_TYPE, WHEN_CHANGED_TYPE,
+	LAST_SIGN_IN_TYPE, LAST_SIGN_IN_SOURCE_TYPE, LAST_SIGN_IN_PRECISION_TYPE, LAST_SIGN_IN_ERROR_TYPE}
+
+// FILE_TIME_ATTRS and GENERALIZED_TIME_ATTRS are the user time attributes,
+// they are returned as RFC 3339 times
+var FILE_TIME_ATTRS = []string{LAST_LOGIN_TYPE, LAST_LOGON_TIMESTAMP_TYPE, PASSWORD_LAST_SET, ACCT_EXPIRES_TYPE, LOCKOUT_TIME_TYPE, BAD_PASSWORD_TIME_TYPE}
+var GENERALIZED_TIME_ATTRS = []string{WHEN_CREATED_TYPE, WHEN_CHANGED_TYPE}
+var GROUP_STANDARD_ATTRS = []string{GROUP_NAME_TYPE, GROUP_TYPE, GROUP_COMMON_NAME, GROUP_DESCRIPTION_TYPE, GROUP_MAIL_TYPE, GROUP_MANAGED_BY_TYPE, GROUP_INFO_TYPE, WHEN_CREATED_TYPE}
+var GROUP_OBJECT_ATTRS = []string{GROUP_NAME_TYPE, GROUP_TYPE, GROUP_COMMON_NAME}
+var GROUP_MANAGED_ATTRS = []string{OBJ_CLASS_TYPE, GROUP_NAME_TYPE, GROUP_COMMON_NAME, SAM_ACCT_NAME_TYPE, GROUP_TYPE, INSTANCE_TYPE, WHEN_CREATED_TYPE, WHEN_CHANGED_TYPE, DN_TYPE, MEMBER_TYPE}
+
+// GROUP_MULTI_VALUED_ATTRS are written as a list when given in Extra, the
+// values joined with a semicolon the way they are returned
+var GROUP_MULTI_VALUED_ATTRS = []string{"url", "otherTelephone", "proxyAddresses", "otherMailbox", "seeAlso"}
+
+// LDAP_MATCHING_RULE_IN_CHAIN walks the chain of ancestry of a DN valued
+// attribute, e.g. all groups a user belongs to through nesting
+const LDAP_MATCHING_RULE_IN_CHAIN = "1.2.840.113556.1.4.1941"
+
+// LDAP_MATCHING_RULE_BIT_AND matches when all the given bits are set in an
+// integer attribute, e.g. the disabled flag in userAccountControl
+const LDAP_MATCHING_RULE_BIT_AND = "1.2.840.113556.1.4.803"
 
 const ACTIVE_DIRECTORY = "active-directory"
 const PAGE_SIZE = 100
+
+// DN_BATCH_SIZE is the number of DNs combined into a single search filter
+const DN_BATCH_SIZE = 50
+
+// MEMBER_BATCH_SIZE is the number of member values added or removed in a
+// single modify request
+const MEMBER_BATCH_SIZE = 500
@@ -0,0 +1,142 @@
+// Package adtime converts Active Directory file times, GeneralizedTime values
+// and policy intervals. "Not set" and "never" decode to the zero time.
+package adtime
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EpochOffset is the number of 100ns intervals between the Windows epoch
+// (1601-01-01) and the Unix epoch
+const EpochOffset = 116444736000000000
+
+// Never is the largest file time, AD uses it for "never" in accountExpires
+// and the lockout and password age policies
+const Never = math.MaxInt64
+
+const generalizedTimeLayout = "20060102150405"
+
+// FromFileTime converts a file time. 0, negative values and Never are the
+// sentinels for not set or never and give the zero time.
+func FromFileTime(ft int64) time.Time {
+	if ft <= 0 || ft == Never {
+		return time.Time{}
+	}
+
+	ft -= EpochOffset
+	return time.Unix(ft/10000000, (ft%10000000)*100).UTC()
+}
+
+// ToFileTime converts a time into a file time, the zero time gives 0
+func ToFileTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()*10000000 + int64(t.Nanosecond()/100) + EpochOffset
+}
+
+// ParseFileTime parses the string value of a file time attribute
+func ParseFileTime(val string) (time.Time, error) {
+	ft, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid file time %v", val)
+	}
+	return FromFileTime(ft), nil
+}
+
+// FormatFileTime returns the string value to write to a file time attribute
+func FormatFileTime(t time.Time) string {
+	return strconv.FormatInt(ToFileTime(t), 10)
+}
+
+// FromInterval converts a policy interval. 0 and math.MinInt64 are the "none"
+// and "never" sentinels and give 0, as do intervals too long for a Duration.
+func FromInterval(iv int64) time.Duration {
+	if iv == math.MinInt64 {
+		return 0
+	}
+	if iv < 0 {
+		iv = -iv
+	}
+	if iv > math.MaxInt64/100 {
+		return 0
+	}
+	return time.Duration(iv * 100)
+}
+
+// ParseInterval parses the string value of a policy interval attribute
+func ParseInterval(val string) (time.Duration, error) {
+	iv, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid interval %v", val)
+	}
+	return FromInterval(iv), nil
+}
+
+// ParseGeneralizedTime parses an LDAP GeneralizedTime, e.g.
+// 20220618042640.0Z or 20220618042640.123-0500. The fraction and the zone
+// are optional, times without a zone are taken as UTC. The Windows epoch
+// (16010101000000.0Z) is the not set sentinel and gives the zero time.
+func ParseGeneralizedTime(val string) (time.Time, error) {
+	val = strings.TrimSpace(val)
+	if len(val) < len(generalizedTimeLayout) {
+		return time.Time{}, fmt.Errorf("invalid generalized time %v", val)
+	}
+
+	t, err := time.ParseInLocation(generalizedTimeLayout, val[:len(generalizedTimeLayout)], time.UTC)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid generalized time %v", val)
+	}
+	rest := val[len(generalizedTimeLayout):]
+
+	if strings.HasPrefix(rest, ".") || strings.HasPrefix(rest, ",") {
+		end := 1
+		for end < len(rest) && rest[end] >= '0' && rest[end] <= '9' {
+			end++
+		}
+		if end > 1 {
+			frac, _ := strconv.ParseFloat("0."+rest[1:end], 64)
+			t = t.Add(time.Duration(frac * float64(time.Second)))
+		}
+		rest = rest[end:]
+	}
+
+	switch {
+	case rest == "" || rest == "Z":
+	case len(rest) == 5 && (rest[0] == '+' || rest[0] == '-'):
+		hours, herr := strconv.Atoi(rest[1:3])
+		mins, merr := strconv.Atoi(rest[3:5])
+		if herr != nil || merr != nil {
+			return time.Time{}, fmt.Errorf("invalid generalized time %v", val)
+		}
+		offset := time.Duration(hours)*time.Hour + time.Duration(mins)*time.Minute
+		if rest[0] == '+' {
+			offset = -offset
+		}
+		t = t.Add(offset)
+	default:
+		return time.Time{}, fmt.Errorf("invalid generalized time %v", val)
+	}
+
+	if t.Year() <= 1601 {
+		return time.Time{}, nil
+	}
+	return t.UTC(), nil
+}
+
+// FormatGeneralizedTime formats a time the way AD writes GeneralizedTime
+func FormatGeneralizedTime(t time.Time) string {
+	return t.UTC().Format(generalizedTimeLayout) + ".0Z"
+}
+
+// Format formats a decoded time as RFC 3339, empty for the zero time
+func Format(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
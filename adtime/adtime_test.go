@@ -0,0 +1,84 @@
+package adtime
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTime(t *testing.T) {
+	assert.Equal(t, ToFileTime(time.Unix(0, 0)), int64(EpochOffset))
+	assert.Equal(t, FromFileTime(EpochOffset), time.Unix(0, 0).UTC())
+	assert.Equal(t, FromFileTime(133000000000000000), time.Date(2022, time.June, 18, 4, 26, 40, 0, time.UTC))
+
+	ts := time.Date(2030, time.March, 31, 23, 59, 59, 500, time.UTC)
+	assert.Equal(t, FromFileTime(ToFileTime(ts)), ts.Truncate(100*time.Nanosecond))
+
+	assert.True(t, FromFileTime(0).IsZero())
+	assert.True(t, FromFileTime(-1).IsZero())
+	assert.True(t, FromFileTime(Never).IsZero())
+	assert.Equal(t, ToFileTime(time.Time{}), int64(0))
+}
+
+func TestParseFileTime(t *testing.T) {
+	ts, err := ParseFileTime("133000000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, Format(ts), "2022-06-18T04:26:40Z")
+
+	ts, err = ParseFileTime(strconv.FormatInt(Never, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, Format(ts), "")
+
+	_, err = ParseFileTime("yesterday")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, FormatFileTime(time.Date(2022, time.June, 18, 4, 26, 40, 0, time.UTC)), "133000000000000000")
+}
+
+func TestInterval(t *testing.T) {
+	assert.Equal(t, FromInterval(-36288000000000), 42*24*time.Hour)
+	assert.Equal(t, FromInterval(-18000000000), 30*time.Minute)
+	assert.Equal(t, FromInterval(18000000000), 30*time.Minute)
+	assert.Equal(t, FromInterval(0), time.Duration(0))
+	assert.Equal(t, FromInterval(math.MinInt64), time.Duration(0))
+	assert.Equal(t, FromInterval(math.MaxInt64), time.Duration(0))
+
+	d, err := ParseInterval("-9223372036854775808")
+	assert.Nil(t, err)
+	assert.Equal(t, d, time.Duration(0))
+
+	d, err = ParseInterval("-864000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, d, 24*time.Hour)
+
+	_, err = ParseInterval("42 days")
+	assert.NotNil(t, err)
+}
+
+func TestGeneralizedTime(t *testing.T) {
+	ts, err := ParseGeneralizedTime("20220618042640.0Z")
+	assert.Nil(t, err)
+	assert.Equal(t, ts, time.Date(2022, time.June, 18, 4, 26, 40, 0, time.UTC))
+
+	ts, err = ParseGeneralizedTime("20220618042640.5-0130")
+	assert.Nil(t, err)
+	assert.Equal(t, ts, time.Date(2022, time.June, 18, 5, 56, 40, 500000000, time.UTC))
+
+	ts, err = ParseGeneralizedTime("20220618042640")
+	assert.Nil(t, err)
+	assert.Equal(t, Format(ts), "2022-06-18T04:26:40Z")
+
+	ts, err = ParseGeneralizedTime("16010101000000.0Z")
+	assert.Nil(t, err)
+	assert.True(t, ts.IsZero())
+
+	_, err = ParseGeneralizedTime("2022-06-18")
+	assert.NotNil(t, err)
+	_, err = ParseGeneralizedTime("20220618042640.0X")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, FormatGeneralizedTime(time.Date(2022, time.June, 18, 4, 26, 40, 0, time.UTC)), "20220618042640.0Z")
+}
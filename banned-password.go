@@ -0,0 +1,284 @@
+package cloudyad
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const BANNED_PASSWORD_MESSAGE = "The password is on the list of banned passwords."
+
+// BLOOM_FILTER_MAGIC starts a bloom filter file
+const BLOOM_FILTER_MAGIC = "ADBLOOM1"
+
+const sha1PrefixLength = 5
+
+// BannedPasswords is a source of banned passwords
+type BannedPasswords interface {
+	Banned(ctx context.Context, pwd string) (bool, error)
+}
+
+// SetBannedPasswords replaces the banned password source of the
+// configuration, nil turns the check off
+func (um *AdUserManager) SetBannedPasswords(banned BannedPasswords) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	um.banned = banned
+	um.bannedLoaded = true
+}
+
+// bannedPasswords loads the configured source on first use
+func (um *AdUserManager) bannedPasswords() (BannedPasswords, error) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+
+	if um.bannedLoaded || um.cfg.BannedPasswordsFile == "" {
+		return um.banned, nil
+	}
+
+	banned, err := LoadBannedPasswords(um.cfg.BannedPasswordsFile)
+	if err != nil {
+		return nil, err
+	}
+	um.banned = banned
+	um.bannedLoaded = true
+	return banned, nil
+}
+
+// checkBannedPassword returns a *PasswordError when a password is banned
+func (um *AdUserManager) checkBannedPassword(ctx context.Context, pwd string) error {
+	banned, err := um.bannedPasswords()
+	if err != nil || banned == nil {
+		return err
+	}
+
+	isBanned, err := banned.Banned(ctx, pwd)
+	if err != nil {
+		return err
+	}
+	if isBanned {
+		return &PasswordError{
+			Code:       ERROR_PASSWORD_RESTRICTION,
+			Message:    BANNED_PASSWORD_MESSAGE,
+			Violations: []string{BANNED_PASSWORD_MESSAGE},
+		}
+	}
+	return nil
+}
+
+// LoadBannedPasswords opens a banned password source, a directory of SHA-1
+// ranges, a bloom filter or a word list
+func LoadBannedPasswords(path string) (BannedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &bannedHashRanges{dir: path}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(len(BLOOM_FILTER_MAGIC))
+	if string(magic) == BLOOM_FILTER_MAGIC {
+		return ReadBloomFilter(r)
+	}
+	return readBannedWordList(r)
+}
+
+// passwordVariants are the forms of a password that are checked
+func passwordVariants(pwd string) []string {
+	lower := strings.ToLower(pwd)
+	if lower == pwd {
+		return []string{pwd}
+	}
+	return []string{pwd, lower}
+}
+
+// bannedWordList holds a password per line, empty lines and # comments are
+// skipped
+type bannedWordList map[string]bool
+
+func readBannedWordList(r io.Reader) (bannedWordList, error) {
+	words := make(bannedWordList)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words[strings.ToLower(word)] = true
+	}
+	return words, scanner.Err()
+}
+
+func (l bannedWordList) Banned(ctx context.Context, pwd string) (bool, error) {
+	return l[strings.ToLower(pwd)], nil
+}
+
+// bannedHashRanges is a file per 5 character SHA-1 prefix in the Pwned
+// Passwords range format
+type bannedHashRanges struct {
+	dir string
+}
+
+func (h *bannedHashRanges) Banned(ctx context.Context, pwd string) (bool, error) {
+	for _, variant := range passwordVariants(pwd) {
+		sum := sha1.Sum([]byte(variant))
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		found, err := h.inRange(hash[:sha1PrefixLength], hash[sha1PrefixLength:])
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// inRange looks for a hash suffix in the range file of its prefix, a missing
+// range file has no banned passwords
+func (h *bannedHashRanges) inRange(prefix string, suffix string) (bool, error) {
+	f, err := os.Open(filepath.Join(h.dir, prefix))
+	if os.IsNotExist(err) {
+		f, err = os.Open(filepath.Join(h.dir, prefix+".txt"))
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// BloomFilter is a compact set of SHA-1 password hashes. It can report a
+// password that was never added as banned, at the false positive rate it was
+// sized for, but never misses one that was added.
+type BloomFilter struct {
+	k    uint32
+	m    uint64
+	bits []byte
+}
+
+// NewBloomFilter sizes a filter for n passwords at a false positive rate
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.001
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{k: k, m: m, bits: make([]byte, (m+7)/8)}
+}
+
+// Add adds a password
+func (f *BloomFilter) Add(pwd string) {
+	f.AddHash(sha1.Sum([]byte(pwd)))
+}
+
+// AddHash adds the SHA-1 hash of a password
+func (f *BloomFilter) AddHash(sum [sha1.Size]byte) {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// HasHash reports if the SHA-1 hash of a password may have been added
+func (f *BloomFilter) HasHash(sum [sha1.Size]byte) bool {
+	h1, h2 := bloomHashes(sum)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) Banned(ctx context.Context, pwd string) (bool, error) {
+	for _, variant := range passwordVariants(pwd) {
+		if f.HasHash(sha1.Sum([]byte(variant))) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// bloomHashes splits a SHA-1 hash into the two hashes of double hashing
+func bloomHashes(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// WriteTo writes the filter: the magic, k and m big endian and the bits
+func (f *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	var header bytes.Buffer
+	header.WriteString(BLOOM_FILTER_MAGIC)
+	binary.Write(&header, binary.BigEndian, f.k)
+	binary.Write(&header, binary.BigEndian, f.m)
+
+	n, err := w.Write(header.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+	written, err := w.Write(f.bits)
+	return int64(n + written), err
+}
+
+// ReadBloomFilter reads a filter written by WriteTo
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	magic := make([]byte, len(BLOOM_FILTER_MAGIC))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != BLOOM_FILTER_MAGIC {
+		return nil, fmt.Errorf("not a bloom filter file")
+	}
+
+	f := &BloomFilter{}
+	err = binary.Read(r, binary.BigEndian, &f.k)
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &f.m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid bloom filter header: %v", err)
+	}
+	if f.k == 0 || f.m == 0 {
+		return nil, fmt.Errorf("invalid bloom filter header k=%d m=%d", f.k, f.m)
+	}
+
+	f.bits = make([]byte, (f.m+7)/8)
+	_, err = io.ReadFull(r, f.bits)
+	if err != nil {
+		return nil, fmt.Errorf("truncated bloom filter: %v", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,123 @@
+package cloudyad
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBannedWordList(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "banned.txt")
+	err := os.WriteFile(path, []byte("# org specific\nAppliedRes2024\n\nSummer2024!\n"), 0600)
+	assert.Nil(t, err)
+
+	banned, err := LoadBannedPasswords(path)
+	assert.Nil(t, err)
+
+	found, err := banned.Banned(ctx, "appliedres2024")
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	found, _ = banned.Banned(ctx, "SUMMER2024!")
+	assert.True(t, found)
+
+	found, _ = banned.Banned(ctx, "# org specific")
+	assert.False(t, found)
+
+	found, _ = banned.Banned(ctx, "W!SjA-as44")
+	assert.False(t, found)
+}
+
+func TestBannedHashRanges(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	sum := sha1.Sum([]byte("password1"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	err := os.WriteFile(filepath.Join(dir, hash[:5]), []byte("0000000000000000000000000000000000A:3\n"+hash[5:]+":2413945\n"), 0600)
+	assert.Nil(t, err)
+
+	banned, err := LoadBannedPasswords(dir)
+	assert.Nil(t, err)
+
+	found, err := banned.Banned(ctx, "password1")
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	found, _ = banned.Banned(ctx, "Password1")
+	assert.True(t, found)
+
+	// No range file for the prefix
+	found, err = banned.Banned(ctx, "W!SjA-as44")
+	assert.Nil(t, err)
+	assert.False(t, found)
+}
+
+func TestBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	filter := NewBloomFilter(1000, 0.001)
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("password%d", i))
+	}
+	filter.AddHash(sha1.Sum([]byte("letmein")))
+
+	var buf bytes.Buffer
+	_, err := filter.WriteTo(&buf)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "banned.bloom")
+	err = os.WriteFile(path, buf.Bytes(), 0600)
+	assert.Nil(t, err)
+
+	banned, err := LoadBannedPasswords(path)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		found, err := banned.Banned(ctx, fmt.Sprintf("password%d", i))
+		assert.Nil(t, err)
+		assert.True(t, found)
+	}
+	found, _ := banned.Banned(ctx, "LetMeIn")
+	assert.True(t, found)
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		found, _ := banned.Banned(ctx, fmt.Sprintf("W!SjA-as%d", i))
+		if found {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 50)
+
+	_, err = ReadBloomFilter(bytes.NewReader(buf.Bytes()[:20]))
+	assert.NotNil(t, err)
+	_, err = ReadBloomFilter(strings.NewReader("not a filter"))
+	assert.NotNil(t, err)
+}
+
+func TestCheckBannedPassword(t *testing.T) {
+	ctx := context.Background()
+	um := &AdUserManager{}
+	assert.Nil(t, um.checkBannedPassword(ctx, "password1"))
+
+	um.SetBannedPasswords(bannedWordList{"password1": true})
+	err := um.checkBannedPassword(ctx, "Password1")
+	var pwdErr *PasswordError
+	assert.True(t, errors.As(err, &pwdErr))
+	assert.Equal(t, pwdErr.Code, uint32(ERROR_PASSWORD_RESTRICTION))
+	assert.Equal(t, pwdErr.Violations, []string{BANNED_PASSWORD_MESSAGE})
+	assert.Nil(t, um.checkBannedPassword(ctx, "W!SjA-as44"))
+
+	um = &AdUserManager{cfg: AdUserManagerConfig{BannedPasswordsFile: filepath.Join(t.TempDir(), "missing.txt")}}
+	assert.NotNil(t, um.checkBannedPassword(ctx, "W!SjA-as44"))
+}
@@ -0,0 +1,117 @@
+// banned-passwords builds the bloom filter file used as a banned password
+// source by cloudy-ad (AD_BANNED_PASSWORDS_FILE).
+//
+// Each input file has a password per line, or with -hashes a SHA-1 hash per
+// line optionally followed by :count, the format of the Pwned Passwords
+// downloads. Empty lines and lines starting with # are skipped.
+//
+//	banned-passwords -out banned.bloom -rate 0.001 words.txt
+//	banned-passwords -out breached.bloom -hashes pwned-passwords-sha1.txt
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	cloudyad "github.com/appliedres/cloudy-ad"
+)
+
+func main() {
+	out := flag.String("out", "banned.bloom", "bloom filter file to write")
+	rate := flag.Float64("rate", 0.001, "false positive rate")
+	hashes := flag.Bool("hashes", false, "the input files hold SHA-1 hashes instead of passwords")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: banned-passwords [flags] file...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := build(*out, *rate, *hashes, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "banned-passwords: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func build(out string, rate float64, hashes bool, files []string) error {
+	// The filter is sized from the number of entries so the files are read twice
+	count := 0
+	for _, file := range files {
+		err := eachLine(file, func(string) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	filter := cloudyad.NewBloomFilter(count, rate)
+	for _, file := range files {
+		err := eachLine(file, func(line string) error {
+			// Passwords are checked in lower case as well, like a word list
+			if !hashes {
+				filter.Add(strings.ToLower(line))
+				return nil
+			}
+
+			val, _, _ := strings.Cut(line, ":")
+			sum, err := hex.DecodeString(val)
+			if err != nil || len(sum) != 20 {
+				return fmt.Errorf("invalid SHA-1 hash %v in %v", val, file)
+			}
+			filter.AddHash([20]byte(sum))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	_, err = filter.WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%v: %d passwords, false positive rate %v\n", out, count, rate)
+	return nil
+}
+
+func eachLine(file string, fn func(line string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := fn(line)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,495 @@
+package cloudyad
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapDirectory is a thin wrapper around a raw LDAP connection, the managers
+// use it for every operation
+type ldapDirectory struct {
+	address     string
+	user        string
+	pwd         string
+	insecureTLS bool
+	base        string
+	idAttribute string
+	pageSize    int
+
+	mu   sync.Mutex
+	conn *ldap.Conn
+}
+
+func newLdapDirectory(address string, user string, pwd string, insecureTLS bool, base string, idAttribute string, pageSize int) *ldapDirectory {
+	return &ldapDirectory{
+		address:     address,
+		user:        user,
+		pwd:         pwd,
+		insecureTLS: insecureTLS,
+		base:        base,
+		idAttribute: idAttribute,
+		pageSize:    pageSize,
+	}
+}
+
+func (d *ldapDirectory) connectAsNeeded(ctx context.Context) (*ldap.Conn, error) {
+	_ = ctx
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil && !d.conn.IsClosing() {
+		return d.conn, nil
+	}
+
+	conn, err := ldap.DialURL(d.address, ldap.DialWithTLSConfig(&tls.Config{
+		InsecureSkipVerify: d.insecureTLS,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(d.user, d.pwd)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	d.conn = conn
+	return conn, nil
+}
+
+// close drops the connection, the next call connects again
+func (d *ldapDirectory) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+// search runs a paged subtree search below the given base. When a page fails
+// the entries read so far are returned along with the error
+func (d *ldapDirectory) search(ctx context.Context, base string, filter string, attrs []string) ([]*ldap.Entry, error) {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, attrs, nil)
+	res, err := conn.SearchWithPaging(req, uint32(d.pageSize))
+	if res == nil {
+		return nil, err
+	}
+	return res.Entries, err
+}
+
+// entry reads a single object by DN. Returns nil if the object does not exist
+func (d *ldapDirectory) entry(ctx context.Context, dn string, attrs []string) (*ldap.Entry, error) {
+	return d.entryWithControls(ctx, dn, attrs, nil)
+}
+
+// entryWithControls reads a single entry sending the given controls with
+// the search
+func (d *ldapDirectory) entryWithControls(ctx context.Context, dn string, attrs []string, controls []ldap.Control) (*ldap.Entry, error) {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", attrs, controls)
+	res, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+	return res.Entries[0], nil
+}
+
+// domainDN returns the DN of the domain from the rootDSE, the configured base
+// when the rootDSE does not have it
+func (d *ldapDirectory) domainDN(ctx context.Context) (string, error) {
+	root, err := d.entry(ctx, "", []string{DEFAULT_NAMING_CONTEXT_TYPE})
+	if err != nil {
+		return "", err
+	}
+	if root == nil || root.GetEqualFoldAttributeValue(DEFAULT_NAMING_CONTEXT_TYPE) == "" {
+		return d.base, nil
+	}
+	return root.GetEqualFoldAttributeValue(DEFAULT_NAMING_CONTEXT_TYPE), nil
+}
+
+// findOne searches the whole directory base and returns the first match or nil
+func (d *ldapDirectory) findOne(ctx context.Context, filter string, attrs []string) (*ldap.Entry, error) {
+	entries, err := d.search(ctx, d.base, filter, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return entries[0], nil
+}
+
+// userEntry finds a user by the configured id attribute
+func (d *ldapDirectory) userEntry(ctx context.Context, uid string, attrs []string) (*ldap.Entry, error) {
+	return d.findOne(ctx, userFilter(fmt.Sprintf("(%v=%v)", d.idAttribute, ldap.EscapeFilter(uid))), attrs)
+}
+
+// groupEntry finds a group by its common name or account name
+func (d *ldapDirectory) groupEntry(ctx context.Context, name string, attrs []string) (*ldap.Entry, error) {
+	escaped := ldap.EscapeFilter(name)
+	return d.findOne(ctx, groupFilter(fmt.Sprintf("(|(%v=%v)(%v=%v))", GROUP_COMMON_NAME, escaped, SAM_ACCT_NAME_TYPE, escaped)), attrs)
+}
+
+// userFilter restricts a filter to user accounts, an empty filter matches
+// every user
+func userFilter(filter string) string {
+	return fmt.Sprintf("(&(objectClass=user)(objectCategory=person)%v)", wrapFilter(filter))
+}
+
+// groupFilter restricts a filter to groups, an empty filter matches every
+// group
+func groupFilter(filter string) string {
+	return fmt.Sprintf("(&(objectClass=group)%v)", wrapFilter(filter))
+}
+
+// wrapFilter adds the parentheses a filter component needs when the caller
+// left them out, e.g. department=Sales
+func wrapFilter(filter string) string {
+	if filter == "" || strings.HasPrefix(filter, "(") {
+		return filter
+	}
+	return "(" + filter + ")"
+}
+
+func (d *ldapDirectory) modify(ctx context.Context, req *ldap.ModifyRequest) error {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Modify(req)
+}
+
+func (d *ldapDirectory) modifyDN(ctx context.Context, req *ldap.ModifyDNRequest) error {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.ModifyDN(req)
+}
+
+// moveEntry changes the RDN and / or the parent of an entry and returns the new DN.
+// An empty rdn keeps the current one, an empty parent keeps the current container.
+func (d *ldapDirectory) moveEntry(ctx context.Context, dn string, rdn string, parent string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+	if len(parsed.RDNs) == 0 {
+		return "", fmt.Errorf("invalid DN %v", dn)
+	}
+
+	if rdn == "" {
+		rdn = parsed.RDNs[0].String()
+	}
+
+	err = d.modifyDN(ctx, ldap.NewModifyDNRequest(dn, rdn, true, parent))
+	if err != nil {
+		return "", err
+	}
+
+	if parent == "" {
+		parent = (&ldap.DN{RDNs: parsed.RDNs[1:]}).String()
+	}
+	return fmt.Sprintf("%v,%v", rdn, parent), nil
+}
+
+// renameEntry sets the CN and sAMAccountName of an entry to a new name, in one
+// modify with the changes added by update (which may be nil). The CN change
+// is undone when the modify fails.
+func (d *ldapDirectory) renameEntry(ctx context.Context, dn string, newName string, update func(req *ldap.ModifyRequest)) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", err
+	}
+	if len(parsed.RDNs) == 0 {
+		return "", fmt.Errorf("invalid DN %v", dn)
+	}
+	oldRDN := parsed.RDNs[0].String()
+
+	domain, err := d.domainDN(ctx)
+	if err != nil {
+		return "", err
+	}
+	taken, err := d.search(ctx, domain, fmt.Sprintf("(%v=%v)", SAM_ACCT_NAME_TYPE, ldap.EscapeFilter(newName)), []string{DN_TYPE})
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range taken {
+		if dnKey(entry.DN) != dnKey(dn) {
+			return "", fmt.Errorf("%v %v is already used by %v", SAM_ACCT_NAME_TYPE, newName, entry.DN)
+		}
+	}
+
+	newDN := dn
+	moved := rdnValue(dn) != newName
+	if moved {
+		newDN, err = d.moveEntry(ctx, dn, commonNameRDN(newName), "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	req := ldap.NewModifyRequest(newDN, nil)
+	req.Replace(SAM_ACCT_NAME_TYPE, []string{newName})
+	if update != nil {
+		update(req)
+	}
+	err = d.modify(ctx, req)
+	if err == nil {
+		return newDN, nil
+	}
+	if !moved {
+		return "", err
+	}
+
+	_, undoErr := d.moveEntry(ctx, newDN, oldRDN, "")
+	if undoErr != nil {
+		return newDN, fmt.Errorf("%v was renamed to %v but updating it failed (%v) and the rename could not be undone: %w", dn, newDN, undoErr, err)
+	}
+	return "", fmt.Errorf("rename of %v to %v undone: %w", dn, newName, err)
+}
+
+func commonNameRDN(name string) string {
+	return fmt.Sprintf("CN=%v", ldap.EscapeDN(name))
+}
+
+// looksLikeDN reports if the value is a distinguished name rather than a plain id
+func looksLikeDN(val string) bool {
+	dn, err := ldap.ParseDN(val)
+	if err != nil {
+		return false
+	}
+	return len(dn.RDNs) > 1
+}
+
+// attributeString flattens an attribute value as returned by adc. Multiple
+// values are joined with a semicolon.
+func attributeString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ";")
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// attributeValues splits a flattened value back into its values
+func attributeValues(val string) []string {
+	var vals []string
+	for _, v := range strings.Split(val, ";") {
+		if v != "" {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// entryAttributes flattens the attributes of a raw entry the same way adc does,
+// skipping the named attributes
+func entryAttributes(entry *ldap.Entry, skip ...string) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	for _, attr := range entry.Attributes {
+		skipped := false
+		for _, s := range skip {
+			if strings.EqualFold(attr.Name, s) {
+				skipped = true
+				break
+			}
+		}
+		if !skipped {
+			attrs[attr.Name] = strings.Join(attr.Values, ";")
+		}
+	}
+	return attrs
+}
+
+// isObjectClass reports if the entry has the given object class
+func isObjectClass(entry *ldap.Entry, class string) bool {
+	for _, v := range entry.GetEqualFoldAttributeValues(OBJ_CLASS_TYPE) {
+		if strings.EqualFold(v, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnsupportedFilterError reports errors returned by servers that do not
+// understand a matching rule used in a filter
+func isUnsupportedFilterError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultInappropriateMatching) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultProtocolError) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultOperationsError)
+}
+
+func (d *ldapDirectory) add(ctx context.Context, req *ldap.AddRequest) error {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Add(req)
+}
+
+func (d *ldapDirectory) del(ctx context.Context, dn string) error {
+	conn, err := d.connectAsNeeded(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Del(ldap.NewDelRequest(dn, nil))
+}
+
+// allValues returns every value of a multi valued attribute on an entry that
+// was already read. AD returns at most MaxValRange (1500 by default) values
+// per read, a larger attribute comes back as e.g. "member;range=0-1499" and
+// the rest is read with range syntax.
+func (d *ldapDirectory) allValues(ctx context.Context, entry *ldap.Entry, attr string) ([]string, error) {
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, attr) {
+			return a.Values, nil
+		}
+
+		high, ok := parseRange(a.Name, attr)
+		if !ok {
+			continue
+		}
+		if high < 0 {
+			return a.Values, nil
+		}
+
+		rest, err := d.rangedValues(ctx, entry.DN, attr, high+1)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]string{}, a.Values...), rest...), nil
+	}
+	return nil, nil
+}
+
+// rangedValues reads the values of a multi valued attribute starting at the
+// given index, one range at a time
+func (d *ldapDirectory) rangedValues(ctx context.Context, dn string, attr string, start int) ([]string, error) {
+	var values []string
+	for {
+		entry, err := d.entry(ctx, dn, []string{fmt.Sprintf("%v;range=%d-*", attr, start)})
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return values, nil
+		}
+
+		found := false
+		for _, a := range entry.Attributes {
+			high, ok := parseRange(a.Name, attr)
+			if !ok {
+				continue
+			}
+			found = true
+			values = append(values, a.Values...)
+			if high < 0 {
+				return values, nil
+			}
+			start = high + 1
+		}
+		if !found {
+			return values, nil
+		}
+	}
+}
+
+// parseRange parses a ranged attribute name such as "member;range=0-1499".
+// Returns the upper bound of the range, -1 for the final range ("*")
+func parseRange(name string, attr string) (int, bool) {
+	prefix := attr + ";range="
+	if len(name) <= len(prefix) || !strings.EqualFold(name[:len(prefix)], prefix) {
+		return 0, false
+	}
+
+	bounds := strings.SplitN(name[len(prefix):], "-", 2)
+	if len(bounds) != 2 {
+		return 0, false
+	}
+	if bounds[1] == "*" {
+		return -1, true
+	}
+
+	high, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return 0, false
+	}
+	return high, true
+}
+
+// entriesByDN reads a set of entries in batched searches rather than one
+// read per DN
+func (d *ldapDirectory) entriesByDN(ctx context.Context, dns []string, attrs []string) ([]*ldap.Entry, error) {
+	return d.entriesByValue(ctx, "", DN_TYPE, dns, attrs)
+}
+
+// entriesByValue reads the entries that have one of the values for an
+// attribute, DN_BATCH_SIZE values at a time. The optional filter further
+// restricts the entries, e.g. to a single object class.
+func (d *ldapDirectory) entriesByValue(ctx context.Context, filter string, attr string, vals []string, attrs []string) ([]*ldap.Entry, error) {
+	var entries []*ldap.Entry
+	for start := 0; start < len(vals); start += DN_BATCH_SIZE {
+		end := start + DN_BATCH_SIZE
+		if end > len(vals) {
+			end = len(vals)
+		}
+
+		var sb strings.Builder
+		sb.WriteString("(|")
+		for _, val := range vals[start:end] {
+			sb.WriteString(fmt.Sprintf("(%v=%v)", attr, ldap.EscapeFilter(val)))
+		}
+		sb.WriteString(")")
+
+		query := sb.String()
+		if filter != "" {
+			query = fmt.Sprintf("(&%v%v)", filter, query)
+		}
+
+		found, err := d.search(ctx, d.base, query, attrs)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+// rdnValue returns the value of the first RDN of a DN, e.g. the CN
+func rdnValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
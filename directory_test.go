@@ -0,0 +1,36 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	high, ok := parseRange("member;range=0-1499", MEMBER_TYPE)
+	assert.True(t, ok)
+	assert.Equal(t, high, 1499)
+
+	high, ok = parseRange("Member;Range=1500-*", MEMBER_TYPE)
+	assert.True(t, ok)
+	assert.Equal(t, high, -1)
+
+	_, ok = parseRange("member", MEMBER_TYPE)
+	assert.False(t, ok)
+
+	_, ok = parseRange("memberOf;range=0-1499", MEMBER_TYPE)
+	assert.False(t, ok)
+
+	_, ok = parseRange("member;range=0-abc", MEMBER_TYPE)
+	assert.False(t, ok)
+}
+
+func TestGroupAttributeValues(t *testing.T) {
+	assert.Equal(t, attributeValues("a;b;;c"), []string{"a", "b", "c"})
+	assert.Equal(t, attributeString(attributeValues("a;b")), "a;b")
+
+	assert.Equal(t, groupAttributeValues("url", "https://a;https://b", false), []string{"https://a", "https://b"})
+	assert.Equal(t, groupAttributeValues("description", "a; b", false), []string{"a; b"})
+	assert.Equal(t, groupAttributeValues("telephoneNumber", "1;2", true), []string{"1", "2"})
+	assert.Equal(t, groupAttributeValues("url", "", false), []string{})
+}
@@ -0,0 +1,293 @@
+package cloudyad
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DYNAMIC_GROUP_PREFIX marks a dynamic group definition stored on the group
+const DYNAMIC_GROUP_PREFIX = "dynamic-group:"
+
+const (
+	DYNAMIC_OP_EQUALS      = "eq"
+	DYNAMIC_OP_NOT_EQUALS  = "ne"
+	DYNAMIC_OP_STARTS_WITH = "startsWith"
+	DYNAMIC_OP_ENDS_WITH   = "endsWith"
+	DYNAMIC_OP_CONTAINS    = "contains"
+	DYNAMIC_OP_PRESENT     = "present"
+	DYNAMIC_OP_ABSENT      = "absent"
+)
+
+var attributeNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+// DynamicGroup defines the membership of a group. Filter is a raw LDAP filter
+// and Rule a structured rule, when both are set a user has to match both.
+type DynamicGroup struct {
+	Group  string       `json:"group"`
+	Filter string       `json:"filter,omitempty"`
+	Rule   *DynamicRule `json:"rule,omitempty"`
+}
+
+// DynamicRule matches users that meet all the All conditions and at least
+// one of the Any conditions. EnabledOnly leaves out disabled accounts.
+type DynamicRule struct {
+	All         []DynamicCondition `json:"all,omitempty"`
+	Any         []DynamicCondition `json:"any,omitempty"`
+	EnabledOnly bool               `json:"enabledOnly,omitempty"`
+}
+
+// DynamicCondition compares a single user attribute
+type DynamicCondition struct {
+	Attribute string `json:"attribute"`
+	Operator  string `json:"op"`
+	Value     string `json:"value,omitempty"`
+}
+
+// DynamicGroupDrift is the difference between the members of a dynamic group
+// and the users that match its rule, Missing and Extra are user DNs. Added and
+// Removed are nil in a dry run.
+type DynamicGroupDrift struct {
+	Group   string
+	DryRun  bool
+	Missing []string
+	Extra   []string
+	Added   *MembershipReport
+	Removed *MembershipReport
+}
+
+// InSync reports if the group matched its rule before the reconcile
+func (d *DynamicGroupDrift) InSync() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// UserFilter returns the LDAP filter for the users that belong in the group
+func (dg *DynamicGroup) UserFilter() (string, error) {
+	var parts []string
+	if dg.Filter != "" {
+		filter := dg.Filter
+		if !strings.HasPrefix(filter, "(") {
+			filter = "(" + filter + ")"
+		}
+		_, err := ldap.CompileFilter(filter)
+		if err != nil {
+			return "", fmt.Errorf("invalid dynamic group filter %v: %v", dg.Filter, err)
+		}
+		parts = append(parts, filter)
+	}
+
+	if dg.Rule != nil {
+		filter, err := dg.Rule.filter()
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, filter)
+	}
+
+	if len(parts) == 0 {
+		return "", fmt.Errorf("dynamic group %v has no filter or rule", dg.Group)
+	}
+	return "(&(objectClass=user)(objectCategory=person)" + strings.Join(parts, "") + ")", nil
+}
+
+func (r *DynamicRule) filter() (string, error) {
+	var sb strings.Builder
+	sb.WriteString("(&")
+	for _, cond := range r.All {
+		filter, err := cond.filter()
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(filter)
+	}
+
+	if len(r.Any) > 0 {
+		sb.WriteString("(|")
+		for _, cond := range r.Any {
+			filter, err := cond.filter()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(filter)
+		}
+		sb.WriteString(")")
+	}
+
+	if r.EnabledOnly {
+		sb.WriteString(fmt.Sprintf("(!(%v:%v:=%d))", USER_ACCOUNT_CONTROL_TYPE, LDAP_MATCHING_RULE_BIT_AND, AC_ACCOUNTDISABLE))
+	}
+
+	if len(r.All) == 0 && len(r.Any) == 0 && !r.EnabledOnly {
+		return "", fmt.Errorf("empty dynamic group rule")
+	}
+	sb.WriteString(")")
+	return sb.String(), nil
+}
+
+func (c *DynamicCondition) filter() (string, error) {
+	if !attributeNamePattern.MatchString(c.Attribute) {
+		return "", fmt.Errorf("invalid attribute %v in dynamic group rule", c.Attribute)
+	}
+
+	val := ldap.EscapeFilter(c.Value)
+	switch c.Operator {
+	case DYNAMIC_OP_EQUALS, "":
+		return fmt.Sprintf("(%v=%v)", c.Attribute, val), nil
+	case DYNAMIC_OP_NOT_EQUALS:
+		return fmt.Sprintf("(!(%v=%v))", c.Attribute, val), nil
+	case DYNAMIC_OP_STARTS_WITH:
+		return fmt.Sprintf("(%v=%v*)", c.Attribute, val), nil
+	case DYNAMIC_OP_ENDS_WITH:
+		return fmt.Sprintf("(%v=*%v)", c.Attribute, val), nil
+	case DYNAMIC_OP_CONTAINS:
+		return fmt.Sprintf("(%v=*%v*)", c.Attribute, val), nil
+	case DYNAMIC_OP_PRESENT:
+		return fmt.Sprintf("(%v=*)", c.Attribute), nil
+	case DYNAMIC_OP_ABSENT:
+		return fmt.Sprintf("(!(%v=*))", c.Attribute), nil
+	}
+	return "", fmt.Errorf("invalid operator %v in dynamic group rule", c.Operator)
+}
+
+// SaveDynamicGroup stores the definition on the group itself, in the
+// attribute given by DynamicGroupAttribute (info unless configured)
+func (gm *AdGroupManager) SaveDynamicGroup(ctx context.Context, dg *DynamicGroup) error {
+	_, err := dg.UserFilter()
+	if err != nil {
+		return err
+	}
+
+	grp, err := gm.dir.groupEntry(ctx, dg.Group, []string{DN_TYPE})
+	if err != nil {
+		return err
+	}
+	if grp == nil {
+		return fmt.Errorf("group not found %v", dg.Group)
+	}
+
+	data, err := json.Marshal(dg)
+	if err != nil {
+		return err
+	}
+
+	req := ldap.NewModifyRequest(grp.DN, nil)
+	req.Replace(gm.cfg.DynamicGroupAttribute, []string{DYNAMIC_GROUP_PREFIX + string(data)})
+	return gm.dir.modify(ctx, req)
+}
+
+// GetDynamicGroup reads the definition stored on a group, nil when the group
+// is not a dynamic group
+func (gm *AdGroupManager) GetDynamicGroup(ctx context.Context, groupName string) (*DynamicGroup, error) {
+	grp, err := gm.dir.groupEntry(ctx, groupName, []string{gm.cfg.DynamicGroupAttribute})
+	if err != nil {
+		return nil, err
+	}
+	if grp == nil {
+		return nil, fmt.Errorf("group not found %v", groupName)
+	}
+
+	val := grp.GetEqualFoldAttributeValue(gm.cfg.DynamicGroupAttribute)
+	if !strings.HasPrefix(val, DYNAMIC_GROUP_PREFIX) {
+		return nil, nil
+	}
+
+	dg := &DynamicGroup{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(val, DYNAMIC_GROUP_PREFIX)), dg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dynamic group definition on %v: %v", groupName, err)
+	}
+	if dg.Group == "" {
+		dg.Group = groupName
+	}
+	return dg, nil
+}
+
+// ReconcileDynamicGroup evaluates the rule of a dynamic group in the
+// directory and adds and removes members to match, comparing them by DN. Only
+// user members are managed, nested groups and other members are left alone.
+// In a dry run the drift is reported without changing the group.
+func (gm *AdGroupManager) ReconcileDynamicGroup(ctx context.Context, dg *DynamicGroup, opts *SetMembersOptions) (*DynamicGroupDrift, error) {
+	filter, err := dg.UserFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	matched, err := gm.dir.search(ctx, gm.cfg.UserBase, filter, []string{DN_TYPE})
+	if err != nil {
+		return nil, err
+	}
+
+	grp, err := gm.dir.groupEntry(ctx, dg.Group, []string{MEMBER_TYPE, OBJECT_SID_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if grp == nil {
+		return nil, fmt.Errorf("group not found %v", dg.Group)
+	}
+
+	direct, err := gm.dir.allValues(ctx, grp, MEMBER_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	users, err := gm.dir.entriesByDN(ctx, direct, []string{DN_TYPE, OBJ_CLASS_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	primary, err := gm.dir.primaryGroupMembers(ctx, grp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Users that have the group as their primary group can not be removed
+	// through it, they only count as present
+	current := make(map[string]bool)
+	for _, dn := range primary {
+		current[dnKey(dn)] = false
+	}
+	for _, user := range users {
+		if memberKind(user) == MEMBER_KIND_USER {
+			current[dnKey(user.DN)] = true
+		}
+	}
+
+	drift := &DynamicGroupDrift{Group: dg.Group, DryRun: opts != nil && opts.DryRun}
+	wanted := make(map[string]bool)
+	for _, user := range matched {
+		key := dnKey(user.DN)
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+		if _, ok := current[key]; !ok {
+			drift.Missing = append(drift.Missing, user.DN)
+		}
+	}
+	for _, user := range users {
+		key := dnKey(user.DN)
+		if current[key] && !wanted[key] {
+			drift.Extra = append(drift.Extra, user.DN)
+		}
+	}
+
+	if drift.DryRun {
+		return drift, nil
+	}
+
+	if len(drift.Missing) > 0 {
+		drift.Added, err = gm.AddMembersWithReport(ctx, dg.Group, drift.Missing)
+		if err != nil {
+			return drift, err
+		}
+	}
+	if len(drift.Extra) > 0 {
+		drift.Removed, err = gm.RemoveMembersWithReport(ctx, dg.Group, drift.Extra)
+		if err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
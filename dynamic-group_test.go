@@ -0,0 +1,42 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDynamicGroupFilter(t *testing.T) {
+	dg := &DynamicGroup{
+		Group: "All Engineering",
+		Rule: &DynamicRule{
+			All:         []DynamicCondition{{Attribute: "department", Operator: DYNAMIC_OP_EQUALS, Value: "Engineering"}},
+			Any:         []DynamicCondition{{Attribute: "title", Operator: DYNAMIC_OP_STARTS_WITH, Value: "Senior"}, {Attribute: "manager", Operator: DYNAMIC_OP_ABSENT}},
+			EnabledOnly: true,
+		},
+	}
+
+	filter, err := dg.UserFilter()
+	assert.Nil(t, err)
+	assert.Equal(t, filter, "(&(objectClass=user)(objectCategory=person)(&(department=Engineering)(|(title=Senior*)(!(manager=*)))(!(userAccountControl:1.2.840.113556.1.4.803:=2))))")
+
+	dg = &DynamicGroup{Filter: "department=R&D (*)"}
+	_, err = dg.UserFilter()
+	assert.NotNil(t, err)
+
+	dg = &DynamicGroup{Rule: &DynamicRule{All: []DynamicCondition{{Attribute: "department", Value: "R&D (*)"}}}}
+	filter, err = dg.UserFilter()
+	assert.Nil(t, err)
+	assert.Equal(t, filter, `(&(objectClass=user)(objectCategory=person)(&(department=R&D \28\2a\29)))`)
+
+	dg = &DynamicGroup{Rule: &DynamicRule{All: []DynamicCondition{{Attribute: "dept)(cn=*", Value: "x"}}}}
+	_, err = dg.UserFilter()
+	assert.NotNil(t, err)
+
+	dg = &DynamicGroup{Rule: &DynamicRule{All: []DynamicCondition{{Attribute: "department", Operator: "like", Value: "x"}}}}
+	_, err = dg.UserFilter()
+	assert.NotNil(t, err)
+
+	_, err = (&DynamicGroup{}).UserFilter()
+	assert.NotNil(t, err)
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/models"
 	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/exp/maps"
 
 	"github.com/appliedres/adc"
 )
@@ -38,11 +41,26 @@ type AdGroupManagerConfig struct {
 	InsecureTLS     string
 	UserIdAttribute string
 	PageSize        int
+
+	// GrantLedgerFile keeps the expiry of time-bound memberships when the
+	// forest does not support link TTLs. Without it, or a ledger given to
+	// SetGrantLedger, AddMembersFor fails on such forests. Only one process
+	// may use the file.
+	GrantLedgerFile string
+
+	// DynamicGroupAttribute is the group attribute that holds dynamic group
+	// definitions, info unless set, e.g. to adminDescription or an
+	// extensionAttribute. It can not be written through Extra.
+	DynamicGroupAttribute string
 }
 
 type AdGroupManager struct {
 	cfg    AdGroupManagerConfig
-	client *adc.Client
+	dir    *ldapDirectory
+	ledger GrantLedger
+
+	mu      sync.Mutex
+	linkTTL *bool
 }
 
 func NewAdGroupManager(cfg *AdGroupManagerConfig) *AdGroupManager {
@@ -59,32 +77,16 @@ func NewAdGroupManager(cfg *AdGroupManagerConfig) *AdGroupManager {
 		cfg.PageSize = PAGE_SIZE
 	}
 
-	cl := adc.New(&adc.Config{
-		URL:         cfg.Address,
-		InsecureTLS: insecureTLS,
-		SearchBase:  cfg.Base,
-		Users: &adc.UsersConfigs{
-			SearchBase:  cfg.Base,
-			IdAttribute: cfg.UserIdAttribute,
-			Attributes:  USER_STANDARD_ATTRS,
-		},
-		Groups: &adc.GroupsConfigs{
-			SearchBase:  cfg.Base,
-			IdAttribute: cfg.UserIdAttribute,
-			Attributes:  GROUP_STANDARD_ATTRS,
-		},
-		Bind: &adc.BindAccount{
-			DN:       cfg.User,
-			Password: cfg.Pwd,
-		},
-	})
+	if cfg.DynamicGroupAttribute == "" {
+		cfg.DynamicGroupAttribute = GROUP_INFO_TYPE
+	}
 
 	ad := &AdGroupManager{
-		client: cl,
 		cfg:    *cfg,
+		dir:    newLdapDirectory(cfg.Address, cfg.User, cfg.Pwd, insecureTLS, cfg.Base, cfg.UserIdAttribute, cfg.PageSize),
+		ledger: NewGrantLedger(cfg.GrantLedgerFile),
 	}
 
-	ad.client = cl
 	return ad
 }
 
@@ -95,233 +97,503 @@ func NewAdGroupManagerFromEnv(ctx context.Context, env *cloudy.Environment) *AdG
 	}
 
 	cfg := &AdGroupManagerConfig{
-		Address:         env.Force("AD_HOST"),
-		User:            env.Force("AD_USER"),
-		Pwd:             env.Force("AD_PWD"),
-		Base:            env.Force("AD_BASE"),
-		GroupBase:       env.Force("AD_GROUP_BASE"),
-		UserBase:        env.Force("AD_USER_BASE"),
-		Domain:          env.Force("AD_DOMAIN"),
-		InsecureTLS:     env.Force("AD_INSECURE_TLS"),
-		UserIdAttribute: env.Force("AD_USER_ID_ATTRIBUTE"),
-		PageSize:        int(pageSize),
+		Address:               env.Force("AD_HOST"),
+		User:                  env.Force("AD_USER"),
+		Pwd:                   env.Force("AD_PWD"),
+		Base:                  env.Force("AD_BASE"),
+		GroupBase:             env.Force("AD_GROUP_BASE"),
+		UserBase:              env.Force("AD_USER_BASE"),
+		Domain:                env.Force("AD_DOMAIN"),
+		InsecureTLS:           env.Force("AD_INSECURE_TLS"),
+		UserIdAttribute:       env.Force("AD_USER_ID_ATTRIBUTE"),
+		PageSize:              int(pageSize),
+		GrantLedgerFile:       env.Default("AD_GRANT_LEDGER_FILE", ""),
+		DynamicGroupAttribute: env.Default("AD_DYNAMIC_GROUP_ATTRIBUTE", GROUP_INFO_TYPE),
 	}
 
 	return NewAdGroupManager(cfg)
 }
 
 func (gm *AdGroupManager) connect(ctx context.Context) error {
-	_ = ctx
-	return gm.client.Connect()
+	_, err := gm.dir.connectAsNeeded(ctx)
+	return err
 }
 
-func (um *AdGroupManager) reconnect(ctx context.Context) error {
-	err := um.client.Reconnect(ctx, TICKER_DURATION, MAX_ATTEMPTS)
+func (gm *AdGroupManager) ListGroups(ctx context.Context, filter string, attrs []string) (*[]models.Group, error) {
+	entries, err := gm.dir.search(ctx, gm.dir.base, groupFilter(filter), append(attrs, GROUP_STANDARD_ATTRS...))
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	managers := make(map[string]string)
+	var results []models.Group
+	for _, entry := range entries {
+		group := entryToGroup(entry)
+		gm.resolveManagerId(ctx, group, managers)
+		results = append(results, *group)
+	}
+	return &results, nil
 }
 
-func (um *AdGroupManager) connectAsNeeded(ctx context.Context) error {
-	var err error
-	if !um.client.ConnectedStatus() {
-		err = um.connect(ctx)
-	} else {
-		err = um.reconnect(ctx)
+// Get a specific group by id
+func (gm *AdGroupManager) GetGroup(ctx context.Context, id string) (*models.Group, error) {
+	return gm.GetGroupWithAttributes(ctx, id, nil)
+}
+
+// GetGroupWithAttributes retrieves a group along with additional attributes,
+// returned in Extra
+func (gm *AdGroupManager) GetGroupWithAttributes(ctx context.Context, id string, attrs []string) (*models.Group, error) {
+	entry, err := gm.dir.groupEntry(ctx, id, append(attrs, GROUP_STANDARD_ATTRS...))
+	if err != nil || entry == nil {
+		return nil, err
 	}
-	return err
+
+	group := entryToGroup(entry)
+	gm.resolveManagerId(ctx, group, nil)
+	return group, nil
 }
 
-func (gm *AdGroupManager) ListGroups(ctx context.Context, filter string, attrs []string) (*[]models.Group, error) {
-	var args adc.GetGroupArgs
+// Get a group id from name
+func (gm *AdGroupManager) GetGroupId(ctx context.Context, name string) (string, error) {
+	entry, err := gm.dir.groupEntry(ctx, name, []string{DN_TYPE})
+	if err != nil || entry == nil {
+		return "", err
+	}
+	return entry.DN, nil
+}
 
-	err := gm.connectAsNeeded(ctx)
+// Get all the groups for a single user. The groups are read with a single
+// paged search, groups outside the search base are read directly. When some
+// groups can not be read the rest are returned along with a
+// *PartialResultError naming the failures.
+func (gm *AdGroupManager) GetUserGroups(ctx context.Context, uid string) ([]*models.Group, error) {
+	user, err := gm.dir.userEntry(ctx, uid, []string{MEMBER_OF_TYPE, OBJECT_SID_TYPE, PRIMARY_GROUP_ID_TYPE})
 	if err != nil {
 		return nil, err
 	}
+	if user == nil {
+		return nil, nil
+	}
 
-	args.Attributes = append(attrs, GROUP_STANDARD_ATTRS...)
-	grps, err := gm.client.ListGroups(args, gm.cfg.PageSize, filter)
+	memberOf, err := gm.userGroupDNs(ctx, user)
 	if err != nil {
 		return nil, err
 	}
-	if grps == nil {
+	if len(memberOf) == 0 {
 		return nil, nil
 	}
 
-	var results []models.Group
-	for _, grp := range *grps {
-		results = append(results, *groupAttributesToCloudy(&grp))
+	partial := &PartialResultError{}
+	filter := fmt.Sprintf("(&(objectClass=group)(%v=%v))", MEMBER_TYPE, ldap.EscapeFilter(user.DN))
+	entries, err := gm.dir.search(ctx, gm.dir.base, filter, GROUP_STANDARD_ATTRS)
+	if err != nil {
+		if len(entries) == 0 {
+			return nil, err
+		}
+		partial.add(gm.dir.base, err)
 	}
-	return &results, nil
+
+	byDN := make(map[string]*ldap.Entry)
+	for _, entry := range entries {
+		byDN[dnKey(entry.DN)] = entry
+	}
+
+	var groups []*models.Group
+	for _, dn := range memberOf {
+		entry, ok := byDN[dnKey(dn)]
+		if !ok {
+			entry, err = gm.dir.entry(ctx, dn, GROUP_STANDARD_ATTRS)
+			if err != nil {
+				partial.add(dn, err)
+				continue
+			}
+			if entry == nil {
+				partial.add(dn, fmt.Errorf("group not found %v", dn))
+				continue
+			}
+		}
+
+		groups = append(groups, entryToGroup(entry))
+	}
+
+	return groups, partial.errOrNil()
 }
 
-// Get a specific group by id
-func (gm *AdGroupManager) GetGroup(ctx context.Context, id string) (*models.Group, error) {
-	err := gm.connectAsNeeded(ctx)
+// Create a new Group
+func (gm *AdGroupManager) NewGroup(ctx context.Context, grp *models.Group) (*models.Group, error) {
+	gt, err := ParseGroupType(grp.Type)
 	if err != nil {
 		return nil, err
 	}
 
-	grp, err := gm.client.GetGroup(adc.GetGroupArgs{
-		Dn: gm.buildGroupDN(id),
-	})
+	extra := groupExtraAttributes(grp)
+	err = gm.resolveManagerDN(ctx, extra)
 	if err != nil {
 		return nil, err
 	}
-	if grp == nil {
-		return nil, nil
+
+	req := ldap.NewAddRequest(gm.buildGroupDN(grp.Name), nil)
+	for _, attr := range *cloudyToGroupAttributes(grp, gt, extra, gm.cfg.DynamicGroupAttribute) {
+		req.Attribute(attr.Type, attr.Vals)
+	}
+	err = gm.dir.add(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	return groupAttributesToCloudy(grp), err
+	return gm.GetGroup(ctx, grp.Name)
 }
 
-// Get a group id from name
-func (gm *AdGroupManager) GetGroupId(ctx context.Context, name string) (string, error) {
-	err := gm.connectAsNeeded(ctx)
+// Update a group and report whether it worked. This is a full update, see
+// ModifyGroup for the details and to get the refreshed group back.
+func (gm *AdGroupManager) UpdateGroup(ctx context.Context, grp *models.Group) (bool, error) {
+	_, err := gm.ModifyGroup(ctx, grp)
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
-	args := adc.GetGroupArgs{
-		Id: name,
-	}
-	grp, err := gm.client.GetGroup(args)
-	return grp.DN, err
+	return true, nil
 }
 
-// Get all the groups for a single user
-func (gm *AdGroupManager) GetUserGroups(ctx context.Context, uid string) ([]*models.Group, error) {
-	err := gm.connectAsNeeded(ctx)
+// ModifyGroup updates a group and returns the refreshed group. The group is
+// located by Source (its DN), falling back to ID. A changed Name renames the
+// group (RDN, name and sAMAccountName), a changed Type converts it and the
+// attributes carried in Extra, such as description, are written. An empty
+// value clears the attribute.
+func (gm *AdGroupManager) ModifyGroup(ctx context.Context, grp *models.Group) (*models.Group, error) {
+	extra := groupExtraAttributes(grp)
+	err := gm.resolveManagerDN(ctx, extra)
 	if err != nil {
 		return nil, err
 	}
 
-	user, err := gm.client.GetUser(adc.GetUserArgs{
-		Id:               uid,
-		SkipGroupsSearch: false,
-	})
+	entry, err := gm.currentGroupEntry(ctx, grp, append([]string{GROUP_COMMON_NAME, SAM_ACCT_NAME_TYPE, GROUP_TYPE}, maps.Keys(extra)...))
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, nil
+	if entry == nil {
+		return nil, fmt.Errorf("group not found %v", grp.ID)
 	}
 
-	var groups []*models.Group
-	for _, group := range user.Groups {
-		grp, err := gm.client.GetGroup(adc.GetGroupArgs{
-			Id: group.Id,
-		})
+	current, err := DecodeGroupType(entry.GetEqualFoldAttributeValue(GROUP_TYPE))
+	if err != nil {
+		return nil, err
+	}
+	gt := current
+	if grp.Type != "" && grp.Type != current.String() {
+		gt, err = ParseGroupType(grp.Type)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		if grp == nil {
-			continue
+	}
+	if gt != current {
+		err = gm.prepareGroupType(ctx, entry.DN, current, gt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The type and attribute changes go in the same modify as the rename so
+	// a failed update undoes the rename
+	update := func(req *ldap.ModifyRequest) {
+		if gt != current {
+			req.Replace(GROUP_TYPE, []string{gt.LdapValue()})
+		}
+		for k, v := range extra {
+			current := entry.GetEqualFoldAttributeValues(k)
+			if isManagedGroupAttr(k, gm.cfg.DynamicGroupAttribute) || v == attributeString(current) {
+				continue
+			}
+			req.Replace(k, groupAttributeValues(k, v, len(current) > 1))
+		}
+	}
+
+	dn := entry.DN
+	if grp.Name != "" && (grp.Name != entry.GetEqualFoldAttributeValue(GROUP_COMMON_NAME) || grp.Name != entry.GetEqualFoldAttributeValue(SAM_ACCT_NAME_TYPE)) {
+		dn, err = gm.dir.renameEntry(ctx, dn, grp.Name, update)
+		if err != nil {
+			return nil, err
 		}
+	} else {
+		req := ldap.NewModifyRequest(dn, nil)
+		update(req)
+		if len(req.Changes) > 0 {
+			err = gm.dir.modify(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		groups = append(groups, groupAttributesToCloudy(grp))
+	refreshed, err := gm.dir.entry(ctx, dn, append(maps.Keys(extra), GROUP_STANDARD_ATTRS...))
+	if err != nil || refreshed == nil {
+		return nil, err
 	}
 
-	return groups, nil
+	updated := entryToGroup(refreshed)
+	gm.resolveManagerId(ctx, updated, nil)
+	return updated, nil
 }
 
-// Create a new Group
-func (gm *AdGroupManager) NewGroup(ctx context.Context, grp *models.Group) (*models.Group, error) {
-	err := gm.connectAsNeeded(ctx)
+// ConvertGroupType changes the scope and / or the kind (security or
+// distribution) of an existing group. AD cannot convert directly between
+// global and domain local so those go through universal first. AD still
+// enforces its membership rules, e.g. a global group that is a member of
+// another global group can not become universal.
+func (gm *AdGroupManager) ConvertGroupType(ctx context.Context, groupName string, gt GroupType) (*models.Group, error) {
+	entry, err := gm.dir.groupEntry(ctx, groupName, []string{GROUP_TYPE})
 	if err != nil {
 		return nil, err
 	}
+	if entry == nil {
+		return nil, fmt.Errorf("group not found %v", groupName)
+	}
 
-	err = gm.client.CreateGroup(gm.buildGroupDN(grp.Name), *cloudyToGroupAttributes(grp))
+	current, err := DecodeGroupType(entry.GetEqualFoldAttributeValue(GROUP_TYPE))
+	if err != nil {
+		return nil, err
+	}
+	err = gm.prepareGroupType(ctx, entry.DN, current, gt)
 	if err != nil {
 		return nil, err
 	}
 
-	group, err := gm.client.GetGroup(adc.GetGroupArgs{
-		Dn: gm.buildGroupDN(grp.Name),
-	})
-	if err != nil || group == nil {
+	if current != gt {
+		err = gm.setGroupType(ctx, entry.DN, gt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refreshed, err := gm.dir.entry(ctx, entry.DN, GROUP_STANDARD_ATTRS)
+	if err != nil || refreshed == nil {
 		return nil, err
 	}
-	return groupAttributesToCloudy(group), err
+	return entryToGroup(refreshed), nil
 }
 
-// This is only a rename of the group.
-func (gm *AdGroupManager) UpdateGroup(ctx context.Context, grp *models.Group) (bool, error) {
-	err := gm.connectAsNeeded(ctx)
+// prepareGroupType checks that a group can change type and takes the step
+// through universal that AD needs between global and domain local
+func (gm *AdGroupManager) prepareGroupType(ctx context.Context, dn string, current GroupType, gt GroupType) error {
+	if current.BuiltIn {
+		return fmt.Errorf("cannot convert builtin group %v", dn)
+	}
+	if scopeChangeAllowed(current.Scope, gt.Scope) {
+		return nil
+	}
+	return gm.setGroupType(ctx, dn, GroupType{Scope: GroupScopeUniversal, Security: current.Security})
+}
+
+func (gm *AdGroupManager) setGroupType(ctx context.Context, dn string, gt GroupType) error {
+	req := ldap.NewModifyRequest(dn, nil)
+	req.Replace(GROUP_TYPE, []string{gt.LdapValue()})
+	return gm.dir.modify(ctx, req)
+}
+
+// MoveGroup moves a group into a different container or OU
+func (gm *AdGroupManager) MoveGroup(ctx context.Context, groupName string, newParentDN string) error {
+	entry, err := gm.dir.groupEntry(ctx, groupName, []string{GROUP_COMMON_NAME})
 	if err != nil {
-		return false, err
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("group not found %v", groupName)
 	}
 
-	err = gm.client.RenameGroup(grp.Source, "CN="+grp.Name)
+	_, err = gm.dir.moveEntry(ctx, entry.DN, "", newParentDN)
+	return err
+}
+
+// RenameGroup changes the CN of a group. AD derives name and cn from the new
+// RDN, sAMAccountName is updated to match.
+func (gm *AdGroupManager) RenameGroup(ctx context.Context, groupName string, newName string) error {
+	entry, err := gm.dir.groupEntry(ctx, groupName, []string{GROUP_COMMON_NAME})
 	if err != nil {
-		return false, err
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("group not found %v", groupName)
 	}
 
-	return true, nil
+	_, err = gm.dir.renameEntry(ctx, entry.DN, newName, nil)
+	return err
 }
 
 // Get all the members of a group. This returns partial users only,
 // typically just the user id, name and email fields
 func (gm *AdGroupManager) GetGroupMembers(ctx context.Context, name string) ([]*models.User, error) {
-	err := gm.connectAsNeeded(ctx)
+	return gm.GetGroupMembersWithOptions(ctx, name, nil)
+}
+
+// GetGroupMembersWithOptions returns the members of a group, optionally fully
+// populated. UID is the id attribute, the same as GetUser. Members are not
+// necessarily users, the kind of each member is in the memberKind attribute
+// and its DN in distinguishedName.
+func (gm *AdGroupManager) GetGroupMembersWithOptions(ctx context.Context, name string, opts *GroupMemberOptions) ([]*models.User, error) {
+	grp, err := gm.dir.groupEntry(ctx, name, []string{MEMBER_TYPE, OBJECT_SID_TYPE})
 	if err != nil {
 		return nil, err
 	}
+	if grp == nil {
+		return nil, nil
+	}
 
-	grp, err := gm.client.GetGroup(adc.GetGroupArgs{
-		Id: name,
-	})
+	dns, err := gm.groupMemberDNs(ctx, grp)
 	if err != nil {
 		return nil, err
 	}
-	if grp == nil {
-		return nil, nil
+
+	hydrate := opts != nil && opts.Hydrate
+	attrs := []string{OBJ_CLASS_TYPE, gm.cfg.UserIdAttribute, USERNAME_TYPE, DISPLAY_NAME_TYPE, EMAIL_TYPE}
+	if hydrate {
+		attrs = append(attrs, opts.Attributes...)
+		attrs = append(attrs, USER_STANDARD_ATTRS...)
+	}
+
+	entries, err := gm.dir.entriesByDN(ctx, dns, attrs)
+	if err != nil {
+		return nil, err
 	}
+	byDN := make(map[string]*ldap.Entry)
+	for _, entry := range entries {
+		byDN[dnKey(entry.DN)] = entry
+	}
+
 	users := []*models.User{}
-	for _, user := range grp.Members {
-		usr := &models.User{
-			Username: user.Id,
-			UID:      user.DN,
-		}
-		users = append(users, usr)
+	for _, dn := range dns {
+		users = append(users, gm.memberToCloudy(dn, byDN[dnKey(dn)], hydrate))
 	}
 	return users, nil
 }
 
 // Remove members from a group
 func (gm *AdGroupManager) RemoveMembers(ctx context.Context, groupName string, userNames []string) error {
-	err := gm.connectAsNeeded(ctx)
+	report, err := gm.RemoveMembersWithReport(ctx, groupName, userNames)
 	if err != nil {
 		return err
 	}
-
-	_, err = gm.client.DeleteGroupMembers(groupName, userNames...)
-	return err
+	return report.Err()
 }
 
 // Add member(s) to a group
 func (gm *AdGroupManager) AddMembers(ctx context.Context, groupName string, userNames []string) error {
-	err := gm.connectAsNeeded(ctx)
+	report, err := gm.AddMembersWithReport(ctx, groupName, userNames)
 	if err != nil {
 		return err
 	}
-
-	_, err = gm.client.AddGroupMembers(groupName, userNames...)
-	return err
+	return report.Err()
 }
 
+// DeleteGroup deletes a group and drops its time-bound grants
 func (gm *AdGroupManager) DeleteGroup(ctx context.Context, groupName string) error {
-	err := gm.connectAsNeeded(ctx)
+	entry, err := gm.dir.groupEntry(ctx, groupName, []string{DN_TYPE})
 	if err != nil {
 		return err
 	}
+	if entry == nil {
+		return fmt.Errorf("group not found %v", groupName)
+	}
 
-	return gm.client.DeleteGroup(gm.buildGroupDN(groupName))
+	err = gm.dir.del(ctx, entry.DN)
+	if err != nil {
+		return err
+	}
+	return gm.dropGroupGrants(ctx, entry.DN)
 }
 
+// buildGroupDN returns the DN a new group is created with, existing groups
+// are looked up as they may have been moved
 func (gm *AdGroupManager) buildGroupDN(groupName string) string {
-	return fmt.Sprintf("CN=%v,%v", groupName, gm.cfg.GroupBase)
+	return fmt.Sprintf("%v,%v", commonNameRDN(groupName), gm.cfg.GroupBase)
+}
+
+// currentGroupEntry looks up the directory entry a models.Group refers to
+func (gm *AdGroupManager) currentGroupEntry(ctx context.Context, grp *models.Group, attrs []string) (*ldap.Entry, error) {
+	if grp.Source != "" {
+		entry, err := gm.dir.entry(ctx, grp.Source, attrs)
+		if err != nil || entry != nil {
+			return entry, err
+		}
+	}
+	if grp.ID == "" {
+		return nil, nil
+	}
+	return gm.dir.groupEntry(ctx, grp.ID, attrs)
+}
+
+// resolveManagerId replaces the managedBy DN in Extra with the id of the user
+// it points to. The DN is left in place when it is not a user. The cache is
+// optional and avoids looking up the same manager more than once.
+func (gm *AdGroupManager) resolveManagerId(ctx context.Context, grp *models.Group, cache map[string]string) {
+	extra, ok := grp.Extra.(map[string]string)
+	if !ok || extra[GROUP_MANAGED_BY_TYPE] == "" {
+		return
+	}
+
+	dn := extra[GROUP_MANAGED_BY_TYPE]
+	id, ok := cache[dn]
+	if !ok {
+		id = dn
+		entry, err := gm.dir.entry(ctx, dn, []string{gm.cfg.UserIdAttribute})
+		if err == nil && entry != nil && entry.GetEqualFoldAttributeValue(gm.cfg.UserIdAttribute) != "" {
+			id = entry.GetEqualFoldAttributeValue(gm.cfg.UserIdAttribute)
+		}
+		if cache != nil {
+			cache[dn] = id
+		}
+	}
+	extra[GROUP_MANAGED_BY_TYPE] = id
+}
+
+// resolveManagerDN turns a managedBy user id into the DN AD expects. Values
+// that are already a DN are left alone.
+func (gm *AdGroupManager) resolveManagerDN(ctx context.Context, extra map[string]string) error {
+	manager := extra[GROUP_MANAGED_BY_TYPE]
+	if manager == "" || looksLikeDN(manager) {
+		return nil
+	}
+
+	entry, err := gm.dir.userEntry(ctx, manager, []string{gm.cfg.UserIdAttribute})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("manager not found %v", manager)
+	}
+	extra[GROUP_MANAGED_BY_TYPE] = entry.DN
+	return nil
+}
+
+// groupExtraAttributes returns the LDAP attributes carried in Extra. Extra
+// holds a map[string]string, or a map[string]interface{} after a JSON round trip
+func groupExtraAttributes(grp *models.Group) map[string]string {
+	attrs := make(map[string]string)
+	switch extra := grp.Extra.(type) {
+	case map[string]string:
+		for k, v := range extra {
+			attrs[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range extra {
+			attrs[k] = attributeString(v)
+		}
+	}
+	return attrs
+}
+
+// isManagedGroupAttr reports attributes that are maintained by the manager
+// itself and can not be written through Extra, including the attribute that
+// holds dynamic group definitions
+func isManagedGroupAttr(key string, dynamicAttr string) bool {
+	if strings.EqualFold(key, dynamicAttr) {
+		return true
+	}
+	for _, v := range GROUP_MANAGED_ATTRS {
+		if strings.EqualFold(key, v) {
+			return true
+		}
+	}
+	return false
 }
 
 func groupAttributesToCloudy(adc *adc.Group) *models.Group {
@@ -339,11 +611,39 @@ func groupAttributesToCloudy(adc *adc.Group) *models.Group {
 		grp.ID = fmt.Sprintf("%v", val)
 	}
 
+	val, ok = adc.Attributes[GROUP_TYPE]
+	if ok {
+		gt, err := DecodeGroupType(fmt.Sprintf("%v", val))
+		if err == nil {
+			grp.Type = gt.String()
+		}
+	}
+
+	for k, v := range adc.Attributes {
+		if inGroupObjAttrs(k) {
+			continue
+		}
+		extra, ok := grp.Extra.(map[string]string)
+		if !ok {
+			extra = make(map[string]string)
+			grp.Extra = extra
+		}
+		extra[k] = attributeString(v)
+	}
+
 	grp.Source = adc.DN
 	return grp
 }
 
-func cloudyToGroupAttributes(grp *models.Group) *[]ldap.Attribute {
+// entryToGroup converts a raw directory entry into a group
+func entryToGroup(entry *ldap.Entry) *models.Group {
+	return groupAttributesToCloudy(&adc.Group{
+		DN:         entry.DN,
+		Attributes: entryAttributes(entry, OBJ_CLASS_TYPE, MEMBER_TYPE, MEMBER_OF_TYPE),
+	})
+}
+
+func cloudyToGroupAttributes(grp *models.Group, gt GroupType, extra map[string]string, dynamicAttr string) *[]ldap.Attribute {
 	attrs := []ldap.Attribute{}
 
 	attrs = append(attrs, ldap.Attribute{
@@ -364,8 +664,41 @@ func cloudyToGroupAttributes(grp *models.Group) *[]ldap.Attribute {
 	})
 	attrs = append(attrs, ldap.Attribute{
 		Type: GROUP_TYPE,
-		Vals: []string{fmt.Sprintf("%d", ADS_GROUP_TYPE_DOMAIN_LOCAL_GROUP|ADS_GROUP_TYPE_SECURITY_ENABLED)},
+		Vals: []string{gt.LdapValue()},
 	})
 
+	for k, v := range extra {
+		if v == "" || isManagedGroupAttr(k, dynamicAttr) {
+			continue
+		}
+
+		attrs = append(attrs, ldap.Attribute{
+			Type: k,
+			Vals: groupAttributeValues(k, v, false),
+		})
+	}
+
 	return &attrs
 }
+
+// groupAttributeValues turns an Extra value into the values to write. Values
+// of multi-valued attributes are split on semicolons, other values are
+// written as is.
+func groupAttributeValues(key string, val string, multiValued bool) []string {
+	if val == "" {
+		return []string{}
+	}
+	if multiValued || inAttrList(key, GROUP_MULTI_VALUED_ATTRS) {
+		return attributeValues(val)
+	}
+	return []string{val}
+}
+
+func inGroupObjAttrs(key string) bool {
+	for _, v := range GROUP_OBJECT_ATTRS {
+		if strings.EqualFold(key, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,15 @@ package cloudyad
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/models"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -20,6 +25,43 @@ func initGroupManager() (*AdGroupManager, context.Context, error) {
 
 }
 
+// initManagers creates a group manager and a user manager that share one test
+// container, so users created by one can be members through the other
+func initManagers() (*AdGroupManager, *AdUserManager, context.Context, error) {
+	cfg := CreateGroupADTestContainer()
+
+	groups := NewAdGroupManager(cfg)
+	users := NewAdUserManager(&AdUserManagerConfig{
+		Address:         cfg.Address,
+		User:            cfg.User,
+		Pwd:             cfg.Pwd,
+		Base:            cfg.Base,
+		UserBase:        cfg.UserBase,
+		GroupBase:       cfg.GroupBase,
+		Domain:          cfg.Domain,
+		InsecureTLS:     cfg.InsecureTLS,
+		UserIdAttribute: cfg.UserIdAttribute,
+	})
+	ctx := cloudy.StartContext()
+	err := groups.connect(ctx)
+	if err != nil {
+		return nil, nil, ctx, err
+	}
+	err = users.connect(ctx)
+
+	return groups, users, ctx, err
+}
+
+// newMemberUser creates a test user whose id is its display name
+func newMemberUser(ctx context.Context, users *AdUserManager, first string, last string) (*models.User, error) {
+	return users.NewUser(ctx, &models.User{
+		DisplayName: fmt.Sprintf("%v %v", first, last),
+		FirstName:   first,
+		LastName:    last,
+		Email:       strings.ToLower(fmt.Sprintf("%v.%v@us.af.mil", first, last)),
+	})
+}
+
 func TestGetUserGroups(t *testing.T) {
 	ad, ctx, err := initGroupManager()
 	assert.Nil(t, err)
@@ -131,3 +173,617 @@ func containsUser(users []*models.User, uid string) bool {
 	}
 	return false
 }
+
+func TestMoveRenameGroup(t *testing.T) {
+	ad, ctx, err := initGroupManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	grp, err := ad.NewGroup(ctx, &models.Group{Name: "MoveGroup"})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+
+	err = ad.RenameGroup(ctx, "MoveGroup", "MovedGroup")
+	assert.Nil(t, err)
+
+	entry, err := ad.dir.groupEntry(ctx, "MovedGroup", []string{SAM_ACCT_NAME_TYPE, GROUP_NAME_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.GetAttributeValue(SAM_ACCT_NAME_TYPE), "MovedGroup")
+	assert.Equal(t, entry.GetAttributeValue(GROUP_NAME_TYPE), "MovedGroup")
+
+	err = ad.MoveGroup(ctx, "MovedGroup", "CN=Users,"+ad.cfg.Base)
+	assert.Nil(t, err)
+
+	entry, err = ad.dir.groupEntry(ctx, "MovedGroup", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.DN, "CN=MovedGroup,CN=Users,"+ad.cfg.Base)
+
+	// A moved group is still found by name
+	moved, err := ad.GetGroup(ctx, "MovedGroup")
+	assert.Nil(t, err)
+	assert.NotNil(t, moved)
+	assert.Equal(t, moved.Source, entry.DN)
+
+	// The sAMAccountName is taken by a user in another container, nothing
+	// may change
+	err = ad.RenameGroup(ctx, "MovedGroup", "Administrator")
+	assert.NotNil(t, err)
+
+	entry, err = ad.dir.groupEntry(ctx, "MovedGroup", []string{SAM_ACCT_NAME_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.GetAttributeValue(SAM_ACCT_NAME_TYPE), "MovedGroup")
+
+	err = ad.DeleteGroup(ctx, "MovedGroup")
+	assert.Nil(t, err)
+}
+
+func TestModifyGroup(t *testing.T) {
+	ad, ctx, err := initGroupManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	grp, err := ad.NewGroup(ctx, &models.Group{Name: "ModifyGroup"})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+
+	grp.Name = "ModifiedGroup"
+	grp.Extra = map[string]string{GROUP_DESCRIPTION_TYPE: "A modified group"}
+	updated, err := ad.ModifyGroup(ctx, grp)
+	assert.Nil(t, err)
+	assert.NotNil(t, updated)
+	assert.Equal(t, updated.Name, "ModifiedGroup")
+
+	entry, err := ad.dir.groupEntry(ctx, "ModifiedGroup", []string{SAM_ACCT_NAME_TYPE, GROUP_DESCRIPTION_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.GetAttributeValue(SAM_ACCT_NAME_TYPE), "ModifiedGroup")
+	assert.Equal(t, entry.GetAttributeValue(GROUP_DESCRIPTION_TYPE), "A modified group")
+
+	// Multi-valued attributes keep their values through a round trip
+	updated.Extra = map[string]string{"url": "https://a.example.com;https://b.example.com"}
+	updated, err = ad.ModifyGroup(ctx, updated)
+	assert.Nil(t, err)
+	assert.NotNil(t, updated)
+
+	entry, err = ad.dir.groupEntry(ctx, "ModifiedGroup", []string{"url"})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, entry.GetAttributeValues("url"), []string{"https://a.example.com", "https://b.example.com"})
+
+	updated.Extra = map[string]string{"url": attributeString(entry.GetAttributeValues("url")), GROUP_DESCRIPTION_TYPE: "A; semicolon"}
+	_, err = ad.ModifyGroup(ctx, updated)
+	assert.Nil(t, err)
+
+	entry, err = ad.dir.groupEntry(ctx, "ModifiedGroup", []string{"url", GROUP_DESCRIPTION_TYPE})
+	assert.Nil(t, err)
+	assert.Equal(t, len(entry.GetAttributeValues("url")), 2)
+	assert.Equal(t, entry.GetAttributeValue(GROUP_DESCRIPTION_TYPE), "A; semicolon")
+
+	// Written attributes outside the standard list come back in the result
+	updated.Extra = map[string]string{"url": "https://c.example.com"}
+	updated, err = ad.ModifyGroup(ctx, updated)
+	assert.Nil(t, err)
+	assert.NotNil(t, updated)
+	assert.Equal(t, updated.Extra.(map[string]string)["url"], "https://c.example.com")
+
+	// A changed type converts the group
+	updated.Type = "distribution-domainlocal"
+	updated.Extra = nil
+	updated, err = ad.ModifyGroup(ctx, updated)
+	assert.Nil(t, err)
+	assert.NotNil(t, updated)
+	assert.Equal(t, updated.Type, "distribution-domainlocal")
+
+	// A stale sAMAccountName is resynced even though the CN already matches
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Replace(SAM_ACCT_NAME_TYPE, []string{"StaleName"})
+	err = ad.dir.modify(ctx, req)
+	assert.Nil(t, err)
+
+	_, err = ad.ModifyGroup(ctx, updated)
+	assert.Nil(t, err)
+
+	entry, err = ad.dir.groupEntry(ctx, "ModifiedGroup", []string{SAM_ACCT_NAME_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.GetAttributeValue(SAM_ACCT_NAME_TYPE), "ModifiedGroup")
+
+	err = ad.DeleteGroup(ctx, "ModifiedGroup")
+	assert.Nil(t, err)
+}
+
+func TestGroupTypes(t *testing.T) {
+	ad, ctx, err := initGroupManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	grp, err := ad.NewGroup(ctx, &models.Group{Name: "GlobalGroup", Type: "security-global"})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+	assert.Equal(t, grp.Type, "security-global")
+
+	grp, err = ad.ConvertGroupType(ctx, "GlobalGroup", GroupType{Scope: GroupScopeDomainLocal, Security: false})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+	assert.Equal(t, grp.Type, "distribution-domainlocal")
+
+	err = ad.DeleteGroup(ctx, "GlobalGroup")
+	assert.Nil(t, err)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "BadGroup", Type: "forest"})
+	assert.NotNil(t, err)
+}
+
+func TestGroupAttributes(t *testing.T) {
+	ad, ctx, err := initGroupManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	grp, err := ad.NewGroup(ctx, &models.Group{
+		Name: "AttrGroup",
+		Extra: map[string]string{
+			GROUP_DESCRIPTION_TYPE: "Group with attributes",
+			GROUP_MAIL_TYPE:        "attr-group@appliedres.com",
+			GROUP_INFO_TYPE:        "some notes",
+		},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+
+	extra := groupExtraAttributes(grp)
+	assert.Equal(t, extra[GROUP_DESCRIPTION_TYPE], "Group with attributes")
+	assert.Equal(t, extra[GROUP_MAIL_TYPE], "attr-group@appliedres.com")
+	assert.Equal(t, extra[GROUP_INFO_TYPE], "some notes")
+	assert.NotEqual(t, extra[WHEN_CREATED_TYPE], "")
+
+	grps, err := ad.ListGroups(ctx, "", []string{"whenChanged"})
+	assert.Nil(t, err)
+	assert.NotNil(t, grps)
+	for _, g := range *grps {
+		if g.Name == "AttrGroup" {
+			assert.NotEqual(t, groupExtraAttributes(&g)["whenChanged"], "")
+		}
+	}
+
+	err = ad.DeleteGroup(ctx, "AttrGroup")
+	assert.Nil(t, err)
+}
+
+func TestTransitiveMembership(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	outer, err := ad.NewGroup(ctx, &models.Group{Name: "OuterGroup"})
+	assert.Nil(t, err)
+	inner, err := ad.NewGroup(ctx, &models.Group{Name: "InnerGroup"})
+	assert.Nil(t, err)
+
+	usr, err := newMemberUser(ctx, users, "Transitive", "Member")
+	assert.Nil(t, err)
+	assert.NotNil(t, usr)
+
+	user, err := ad.dir.userEntry(ctx, usr.UID, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+
+	req := ldap.NewModifyRequest(outer.Source, nil)
+	req.Add(MEMBER_TYPE, []string{inner.Source})
+	assert.Nil(t, ad.dir.modify(ctx, req))
+
+	req = ldap.NewModifyRequest(inner.Source, nil)
+	req.Add(MEMBER_TYPE, []string{user.DN})
+	assert.Nil(t, ad.dir.modify(ctx, req))
+
+	memberships, err := ad.GetUserGroupsTransitive(ctx, usr.UID)
+	assert.Nil(t, err)
+	found := map[string]bool{}
+	nested := 0
+	for _, m := range memberships {
+		if len(m.Path) > 0 && m.Path[0] == inner.Source {
+			nested++
+		}
+		if m.Group.Name == "OuterGroup" {
+			found[m.Group.Name] = true
+			assert.Equal(t, m.Path, []string{inner.Source, outer.Source})
+			assert.False(t, m.Direct())
+		}
+		if m.Group.Name == "InnerGroup" {
+			found[m.Group.Name] = true
+			assert.True(t, m.Direct())
+		}
+	}
+	assert.True(t, found["OuterGroup"])
+	assert.True(t, found["InnerGroup"])
+	assert.Equal(t, len(found), 2)
+	// Only InnerGroup and OuterGroup are reached through InnerGroup
+	assert.Equal(t, nested, 2)
+
+	members, err := ad.GetGroupMembersTransitive(ctx, "OuterGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 1)
+	assert.Equal(t, members[0].DN, user.DN)
+	assert.Equal(t, members[0].Path, []string{outer.Source, inner.Source})
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "InnerGroup"))
+	assert.Nil(t, ad.DeleteGroup(ctx, "OuterGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
+
+func TestLargeGroupMembers(t *testing.T) {
+	ad, ctx, err := initGroupManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	// More members than the default MaxValRange of 1500 values per read
+	count := 1600
+
+	grp, err := ad.NewGroup(ctx, &models.Group{Name: "LargeGroup"})
+	assert.Nil(t, err)
+	assert.NotNil(t, grp)
+
+	var dns []string
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("bulk-user-%04d", i)
+		dn := fmt.Sprintf("CN=%v,%v", name, ad.cfg.UserBase)
+
+		req := ldap.NewAddRequest(dn, nil)
+		req.Attribute(OBJ_CLASS_TYPE, USER_OBJ_CLASS_VALS)
+		req.Attribute(SAM_ACCT_NAME_TYPE, []string{name})
+		req.Attribute(DISPLAY_NAME_TYPE, []string{name})
+		assert.Nil(t, ad.dir.add(ctx, req))
+		dns = append(dns, dn)
+	}
+
+	for start := 0; start < len(dns); start += 500 {
+		end := start + 500
+		if end > len(dns) {
+			end = len(dns)
+		}
+		req := ldap.NewModifyRequest(grp.Source, nil)
+		req.Add(MEMBER_TYPE, dns[start:end])
+		assert.Nil(t, ad.dir.modify(ctx, req))
+	}
+
+	users, err := ad.GetGroupMembers(ctx, "LargeGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(users), count)
+
+	members, err := ad.GetGroupMembersTransitive(ctx, "LargeGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), count)
+
+	for _, dn := range dns {
+		assert.Nil(t, ad.dir.del(ctx, dn))
+	}
+	assert.Nil(t, ad.DeleteGroup(ctx, "LargeGroup"))
+}
+
+func TestGroupMemberKinds(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	outer, err := ad.NewGroup(ctx, &models.Group{Name: "KindsGroup"})
+	assert.Nil(t, err)
+	inner, err := ad.NewGroup(ctx, &models.Group{Name: "KindsInnerGroup"})
+	assert.Nil(t, err)
+
+	usr, err := newMemberUser(ctx, users, "Kinds", "Member")
+	assert.Nil(t, err)
+	assert.NotNil(t, usr)
+
+	user, err := ad.dir.userEntry(ctx, usr.UID, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+
+	req := ldap.NewModifyRequest(outer.Source, nil)
+	req.Add(MEMBER_TYPE, []string{inner.Source, user.DN})
+	assert.Nil(t, ad.dir.modify(ctx, req))
+
+	members, err := ad.GetGroupMembersWithOptions(ctx, "KindsGroup", &GroupMemberOptions{Hydrate: true})
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 2)
+	for _, m := range members {
+		switch m.Attributes[DN_TYPE] {
+		case inner.Source:
+			assert.Equal(t, m.Attributes[MEMBER_KIND_TYPE], MEMBER_KIND_GROUP)
+			assert.Equal(t, m.UID, "KindsInnerGroup")
+		case user.DN:
+			assert.Equal(t, m.Attributes[MEMBER_KIND_TYPE], MEMBER_KIND_USER)
+			assert.Equal(t, m.UID, "Kinds Member")
+		default:
+			t.Errorf("unexpected member %v", m.Attributes[DN_TYPE])
+		}
+	}
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "KindsInnerGroup"))
+	assert.Nil(t, ad.DeleteGroup(ctx, "KindsGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
+
+func TestPrimaryGroup(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr, err := newMemberUser(ctx, users, "Primary", "Member")
+	assert.Nil(t, err)
+	assert.NotNil(t, usr)
+
+	groups, err := ad.GetUserGroups(ctx, usr.UID)
+	assert.Nil(t, err)
+	found := false
+	for _, g := range groups {
+		if g.Name == "Domain Users" {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "PrimaryGroup", Type: "security-global"})
+	assert.Nil(t, err)
+
+	err = ad.SetPrimaryGroup(ctx, usr.UID, "PrimaryGroup")
+	assert.NotNil(t, err)
+
+	err = ad.SetPrimaryGroup(ctx, usr.UID, "Domain Users")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "PrimaryGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
+
+func TestSetGroupMembers(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	first, err := newMemberUser(ctx, users, "Sync", "First")
+	assert.Nil(t, err)
+	second, err := newMemberUser(ctx, users, "Sync", "Second")
+	assert.Nil(t, err)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "SyncGroup"})
+	assert.Nil(t, err)
+
+	report, err := ad.SetGroupMembers(ctx, "SyncGroup", []string{first.UID, second.UID, "nosuchuser"}, nil)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, report.Members(MEMBER_STATUS_ADDED), []string{first.UID, second.UID})
+	assert.Equal(t, report.Members(MEMBER_STATUS_NOT_FOUND), []string{"nosuchuser"})
+	assert.Equal(t, len(report.Failed()), 1)
+
+	report, err = ad.SetGroupMembers(ctx, "SyncGroup", []string{second.UID}, &SetMembersOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, report.Members(MEMBER_STATUS_PRESENT), []string{second.UID})
+	assert.Equal(t, len(report.Members(MEMBER_STATUS_REMOVED)), 1)
+
+	members, err := ad.GetGroupMembers(ctx, "SyncGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 2)
+
+	report, err = ad.SetGroupMembers(ctx, "SyncGroup", []string{second.UID}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Failed()), 0)
+
+	members, err = ad.GetGroupMembers(ctx, "SyncGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 1)
+	assert.Equal(t, members[0].UID, second.UID)
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "SyncGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, first.UID))
+	assert.Nil(t, users.DeleteUser(ctx, second.UID))
+}
+
+func TestIdempotentMembers(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	first, err := newMemberUser(ctx, users, "Idempotent", "First")
+	assert.Nil(t, err)
+	second, err := newMemberUser(ctx, users, "Idempotent", "Second")
+	assert.Nil(t, err)
+	outsider, err := newMemberUser(ctx, users, "Idempotent", "Outsider")
+	assert.Nil(t, err)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "IdempotentGroup"})
+	assert.Nil(t, err)
+
+	entry, err := ad.dir.userEntry(ctx, second.UID, []string{OBJECT_SID_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	sid, err := DecodeSID(entry.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	assert.Nil(t, err)
+
+	report, err := ad.AddMembersWithReport(ctx, "IdempotentGroup", []string{first.UID})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_ADDED), []string{first.UID})
+
+	report, err = ad.AddMembersWithReport(ctx, "IdempotentGroup", []string{first.UID, sid, "nosuchuser"})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_PRESENT), []string{first.UID})
+	assert.Equal(t, report.Members(MEMBER_STATUS_ADDED), []string{sid})
+	assert.Equal(t, report.Members(MEMBER_STATUS_NOT_FOUND), []string{"nosuchuser"})
+	assert.NotNil(t, report.Err())
+
+	assert.Nil(t, ad.AddMembers(ctx, "IdempotentGroup", []string{first.UID}))
+
+	report, err = ad.RemoveMembersWithReport(ctx, "IdempotentGroup", []string{entry.DN, outsider.UID})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_REMOVED), []string{entry.DN})
+	assert.Equal(t, report.Members(MEMBER_STATUS_ABSENT), []string{outsider.UID})
+	assert.Nil(t, report.Err())
+
+	assert.Nil(t, ad.RemoveMembers(ctx, "IdempotentGroup", []string{first.UID, first.UID}))
+
+	members, err := ad.GetGroupMembers(ctx, "IdempotentGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 0)
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "IdempotentGroup"))
+	for _, usr := range []*models.User{first, second, outsider} {
+		assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+	}
+}
+
+func TestAddMembersFor(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr, err := newMemberUser(ctx, users, "Timed", "Member")
+	assert.Nil(t, err)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "TimedGroup"})
+	assert.Nil(t, err)
+
+	// Samba has no link TTLs, the grants need a ledger file
+	_, err = ad.AddMembersFor(ctx, "TimedGroup", []string{usr.UID}, 2*time.Second)
+	assert.NotNil(t, err)
+	ad.SetGrantLedger(NewGrantLedger(filepath.Join(t.TempDir(), "grants.json")))
+
+	_, err = ad.AddMembersFor(ctx, "TimedGroup", []string{usr.UID}, 0)
+	assert.NotNil(t, err)
+
+	report, err := ad.AddMembersFor(ctx, "TimedGroup", []string{usr.UID}, 2*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_ADDED), []string{usr.UID})
+
+	grants, err := ad.ListGrants(ctx, "TimedGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 1)
+
+	time.Sleep(3 * time.Second)
+
+	reports, err := ad.ReapExpiredGrants(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(reports), 1)
+	assert.Equal(t, len(reports[0].Members(MEMBER_STATUS_REMOVED)), 1)
+
+	members, err := ad.GetGroupMembers(ctx, "TimedGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 0)
+
+	grants, err = ad.ListGrants(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 0)
+
+	// Removing a member or deleting the group drops the grants
+	_, err = ad.AddMembersFor(ctx, "TimedGroup", []string{usr.UID}, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, ad.RemoveMembers(ctx, "TimedGroup", []string{usr.UID}))
+
+	grants, err = ad.ListGrants(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 0)
+
+	_, err = ad.AddMembersFor(ctx, "TimedGroup", []string{usr.UID}, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, ad.DeleteGroup(ctx, "TimedGroup"))
+
+	grants, err = ad.ListGrants(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 0)
+
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
+
+func TestPermanentAddDropsGrant(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr, err := newMemberUser(ctx, users, "Granted", "Member")
+	assert.Nil(t, err)
+
+	_, err = ad.NewGroup(ctx, &models.Group{Name: "GrantedGroup"})
+	assert.Nil(t, err)
+	ad.SetGrantLedger(NewGrantLedger(filepath.Join(t.TempDir(), "grants.json")))
+
+	report, err := ad.AddMembersFor(ctx, "GrantedGroup", []string{usr.UID}, 2*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_ADDED), []string{usr.UID})
+
+	report, err = ad.AddMembersWithReport(ctx, "GrantedGroup", []string{usr.UID})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Members(MEMBER_STATUS_PRESENT), []string{usr.UID})
+
+	grants, err := ad.ListGrants(ctx, "GrantedGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 0)
+
+	time.Sleep(3 * time.Second)
+
+	reports, err := ad.ReapExpiredGrants(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(reports), 0)
+
+	members, err := ad.GetGroupMembers(ctx, "GrantedGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, len(members), 1)
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "GrantedGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
+
+func TestDynamicGroup(t *testing.T) {
+	ad, users, ctx, err := initManagers()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr, err := newMemberUser(ctx, users, "Dynamic", "Member")
+	assert.Nil(t, err)
+	user, err := ad.dir.userEntry(ctx, usr.UID, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+
+	grp, err := ad.NewGroup(ctx, &models.Group{Name: "DynamicGroup"})
+	assert.Nil(t, err)
+
+	dg := &DynamicGroup{Group: "DynamicGroup", Filter: "(displayName=Dynamic Member)"}
+	assert.Nil(t, ad.SaveDynamicGroup(ctx, dg))
+
+	// Editing the description, or writing the rule attribute through Extra,
+	// keeps the rule
+	grp.Extra = map[string]string{
+		GROUP_DESCRIPTION_TYPE: "some notes",
+		GROUP_INFO_TYPE:        "not a rule",
+	}
+	_, err = ad.ModifyGroup(ctx, grp)
+	assert.Nil(t, err)
+
+	saved, err := ad.GetDynamicGroup(ctx, "DynamicGroup")
+	assert.Nil(t, err)
+	assert.Equal(t, saved, dg)
+
+	drift, err := ad.ReconcileDynamicGroup(ctx, saved, &SetMembersOptions{DryRun: true})
+	assert.Nil(t, err)
+	assert.False(t, drift.InSync())
+	assert.Equal(t, drift.Missing, []string{user.DN})
+	assert.Nil(t, drift.Added)
+
+	drift, err = ad.ReconcileDynamicGroup(ctx, saved, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, drift.Added.Members(MEMBER_STATUS_ADDED), []string{user.DN})
+
+	drift, err = ad.ReconcileDynamicGroup(ctx, saved, nil)
+	assert.Nil(t, err)
+	assert.True(t, drift.InSync())
+
+	// A user that no longer matches is removed
+	dg.Filter = "(displayName=Nobody Matches)"
+	assert.Nil(t, ad.SaveDynamicGroup(ctx, dg))
+
+	drift, err = ad.ReconcileDynamicGroup(ctx, dg, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, drift.Extra, []string{user.DN})
+	assert.Equal(t, drift.Removed.Members(MEMBER_STATUS_REMOVED), []string{user.DN})
+
+	assert.Nil(t, ad.DeleteGroup(ctx, "DynamicGroup"))
+	assert.Nil(t, users.DeleteUser(ctx, usr.UID))
+}
@@ -0,0 +1,394 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	MEMBER_STATUS_ADDED     = "added"
+	MEMBER_STATUS_REMOVED   = "removed"
+	MEMBER_STATUS_PRESENT   = "present"
+	MEMBER_STATUS_ABSENT    = "absent"
+	MEMBER_STATUS_NOT_FOUND = "not-found"
+	MEMBER_STATUS_REJECTED  = "rejected"
+)
+
+// MemberResult is the outcome for a single member of a membership change
+type MemberResult struct {
+	// Member is the member as given by the caller. Members removed because
+	// they were not in the desired list are given by DN.
+	Member string
+	DN     string
+	Status string
+	Err    error
+}
+
+// MembershipReport lists the outcome of a membership change per member. In
+// a dry run the statuses are the changes that would have been made.
+type MembershipReport struct {
+	Group   string
+	DryRun  bool
+	Results []*MemberResult
+}
+
+func (r *MembershipReport) add(member string, dn string, status string, err error) *MemberResult {
+	result := &MemberResult{Member: member, DN: dn, Status: status, Err: err}
+	r.Results = append(r.Results, result)
+	return result
+}
+
+// Members returns the members with the given status
+func (r *MembershipReport) Members(status string) []string {
+	var members []string
+	for _, result := range r.Results {
+		if result.Status == status {
+			members = append(members, result.Member)
+		}
+	}
+	return members
+}
+
+// Failed returns the members that were not found or were rejected by AD
+func (r *MembershipReport) Failed() []*MemberResult {
+	var failed []*MemberResult
+	for _, result := range r.Results {
+		if result.Status == MEMBER_STATUS_NOT_FOUND || result.Status == MEMBER_STATUS_REJECTED {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err returns an error naming the members that failed, or nil
+func (r *MembershipReport) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(failed))
+	for _, result := range failed {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", result.Member, result.Err))
+	}
+	return fmt.Errorf("%d of %d members failed: %v", len(failed), len(r.Results), strings.Join(msgs, "; "))
+}
+
+// SetMembersOptions controls SetGroupMembers
+type SetMembersOptions struct {
+	// DryRun computes the changes without applying them
+	DryRun bool
+}
+
+// SetGroupMembers makes the direct members of a group match the desired list
+// of user ids or DNs and drops their time-bound grants. Users that have the
+// group as their primary group can not be removed and are reported as rejected.
+func (gm *AdGroupManager) SetGroupMembers(ctx context.Context, groupName string, desired []string, opts *SetMembersOptions) (*MembershipReport, error) {
+	grp, err := gm.dir.groupEntry(ctx, groupName, []string{MEMBER_TYPE, OBJECT_SID_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if grp == nil {
+		return nil, fmt.Errorf("group not found %v", groupName)
+	}
+
+	direct, err := gm.dir.allValues(ctx, grp, MEMBER_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := gm.dir.primaryGroupMembers(ctx, grp)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]bool)
+	for _, dn := range mergeDNs(direct, primary) {
+		current[dnKey(dn)] = true
+	}
+
+	resolved, err := gm.dir.memberEntries(ctx, desired, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MembershipReport{Group: grp.DN, DryRun: opts != nil && opts.DryRun}
+	wanted := make(map[string]bool)
+	var adds []*MemberResult
+	for _, member := range desired {
+		entry := resolved[member]
+		if entry == nil {
+			report.add(member, "", MEMBER_STATUS_NOT_FOUND, fmt.Errorf("member not found %v", member))
+			continue
+		}
+
+		key := dnKey(entry.DN)
+		if wanted[key] {
+			continue
+		}
+		wanted[key] = true
+
+		if current[key] {
+			report.add(member, entry.DN, MEMBER_STATUS_PRESENT, nil)
+			continue
+		}
+		adds = append(adds, report.add(member, entry.DN, MEMBER_STATUS_ADDED, nil))
+	}
+
+	var removes []*MemberResult
+	for _, dn := range direct {
+		if !wanted[dnKey(dn)] {
+			removes = append(removes, report.add(dn, dn, MEMBER_STATUS_REMOVED, nil))
+		}
+	}
+	for _, dn := range primary {
+		if !wanted[dnKey(dn)] {
+			report.add(dn, dn, MEMBER_STATUS_REJECTED, fmt.Errorf("%v is the primary group of %v", groupName, dn))
+		}
+	}
+
+	if report.DryRun {
+		return report, nil
+	}
+
+	gm.applyMemberChanges(ctx, grp.DN, adds, true, 0)
+	gm.applyMemberChanges(ctx, grp.DN, removes, false, 0)
+	return report, gm.dropGrants(ctx, report)
+}
+
+// applyMemberChanges adds or removes members MEMBER_BATCH_SIZE at a time.
+// AD fails the whole request for a single bad value so a failed batch is
+// retried one member at a time to find the members that caused it. Members
+// are added with a link TTL when ttl is set.
+func (gm *AdGroupManager) applyMemberChanges(ctx context.Context, groupDN string, results []*MemberResult, add bool, ttl time.Duration) {
+	for start := 0; start < len(results); start += MEMBER_BATCH_SIZE {
+		end := start + MEMBER_BATCH_SIZE
+		if end > len(results) {
+			end = len(results)
+		}
+		batch := results[start:end]
+
+		dns := make([]string, 0, len(batch))
+		for _, result := range batch {
+			dns = append(dns, linkValue(result.DN, ttl))
+		}
+		if gm.modifyMembers(ctx, groupDN, dns, add) == nil {
+			continue
+		}
+
+		for _, result := range batch {
+			err := gm.modifyMembers(ctx, groupDN, []string{linkValue(result.DN, ttl)}, add)
+			setMemberOutcome(result, err, add)
+		}
+	}
+}
+
+func (gm *AdGroupManager) modifyMembers(ctx context.Context, groupDN string, dns []string, add bool) error {
+	req := ldap.NewModifyRequest(groupDN, nil)
+	if add {
+		req.Add(MEMBER_TYPE, dns)
+	} else {
+		req.Delete(MEMBER_TYPE, dns)
+	}
+	return gm.dir.modify(ctx, req)
+}
+
+// setMemberOutcome records the result of changing a single member. Adding a
+// member that is already there, or removing one that is not, is not an error.
+func setMemberOutcome(result *MemberResult, err error, add bool) {
+	switch {
+	case err == nil:
+	case add && ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists),
+		add && ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists):
+		result.Status = MEMBER_STATUS_PRESENT
+	case !add && ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute):
+		result.Status = MEMBER_STATUS_ABSENT
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		result.Status = MEMBER_STATUS_NOT_FOUND
+		result.Err = err
+	default:
+		result.Status = MEMBER_STATUS_REJECTED
+		result.Err = err
+	}
+}
+
+// memberEntries finds the entries for a list of members given by user id,
+// DN, user principal name or SID. The entries are keyed by the member as
+// given, members that could not be found are left out.
+func (d *ldapDirectory) memberEntries(ctx context.Context, members []string, attrs []string) (map[string]*ldap.Entry, error) {
+	var dns, ids, upns []string
+	for _, member := range members {
+		switch {
+		case looksLikeDN(member):
+			dns = append(dns, member)
+		case looksLikeSID(member):
+		default:
+			ids = append(ids, member)
+			if strings.Contains(member, "@") {
+				upns = append(upns, member)
+			}
+		}
+	}
+
+	byDN := make(map[string]*ldap.Entry)
+	entries, err := d.entriesByDN(ctx, dns, append([]string{DN_TYPE}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		byDN[dnKey(entry.DN)] = entry
+	}
+
+	byId := make(map[string]*ldap.Entry)
+	entries, err = d.entriesByValue(ctx, "(&(objectClass=user)(objectCategory=person))", d.idAttribute, ids, append([]string{d.idAttribute}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		byId[strings.ToLower(entry.GetEqualFoldAttributeValue(d.idAttribute))] = entry
+	}
+
+	byUPN := make(map[string]*ldap.Entry)
+	entries, err = d.entriesByValue(ctx, "", USER_PRINCIPAL_NAME_TYPE, upns, append([]string{USER_PRINCIPAL_NAME_TYPE}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		byUPN[strings.ToLower(entry.GetEqualFoldAttributeValue(USER_PRINCIPAL_NAME_TYPE))] = entry
+	}
+
+	results := make(map[string]*ldap.Entry)
+	for _, member := range members {
+		var entry *ldap.Entry
+		switch {
+		case looksLikeDN(member):
+			entry = byDN[dnKey(member)]
+		case looksLikeSID(member):
+			// SIDs are binary in the directory so they can not share a
+			// batched filter with the other values
+			entry, err = d.sidEntry(ctx, member, append([]string{DN_TYPE}, attrs...))
+			if err != nil {
+				return nil, err
+			}
+		default:
+			entry = byId[strings.ToLower(member)]
+			if entry == nil {
+				entry = byUPN[strings.ToLower(member)]
+			}
+		}
+		if entry != nil {
+			results[member] = entry
+		}
+	}
+	return results, nil
+}
+
+// AddMembersWithReport adds members to a group given by user id, DN, user
+// principal name or SID. Members that are already in the group are reported
+// as present rather than failing the request. The members are permanent, any
+// time-bound grant they had is dropped.
+func (gm *AdGroupManager) AddMembersWithReport(ctx context.Context, groupName string, members []string) (*MembershipReport, error) {
+	report, err := gm.changeMembers(ctx, groupName, members, true, 0)
+	if err != nil {
+		return nil, err
+	}
+	return report, gm.dropGrants(ctx, report)
+}
+
+// RemoveMembersWithReport removes members from a group given by user id, DN,
+// user principal name or SID. Members that are not in the group are reported
+// as absent rather than failing the request, they are found by comparing
+// with the current members before anything is removed. Any time-bound grant
+// of the members is dropped.
+func (gm *AdGroupManager) RemoveMembersWithReport(ctx context.Context, groupName string, members []string) (*MembershipReport, error) {
+	report, err := gm.changeMembers(ctx, groupName, members, false, 0)
+	if err != nil {
+		return nil, err
+	}
+	return report, gm.dropGrants(ctx, report)
+}
+
+func (gm *AdGroupManager) changeMembers(ctx context.Context, groupName string, members []string, add bool, ttl time.Duration) (*MembershipReport, error) {
+	attrs := []string{OBJECT_SID_TYPE}
+	if !add {
+		attrs = append(attrs, MEMBER_TYPE)
+	}
+	grp, err := gm.dir.groupEntry(ctx, groupName, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if grp == nil {
+		return nil, fmt.Errorf("group not found %v", groupName)
+	}
+
+	current := make(map[string]bool)
+	if !add {
+		direct, err := gm.dir.allValues(ctx, grp, MEMBER_TYPE)
+		if err != nil {
+			return nil, err
+		}
+		for _, dn := range direct {
+			current[dnKey(dn)] = true
+		}
+	}
+
+	primaryId := ""
+	sid, err := DecodeSID(grp.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	if err == nil && strings.HasPrefix(sid, DOMAIN_SID_PREFIX) {
+		_, rid, err := splitSID(sid)
+		if err == nil {
+			primaryId = strconv.FormatUint(uint64(rid), 10)
+		}
+	}
+
+	resolved, err := gm.dir.memberEntries(ctx, members, []string{PRIMARY_GROUP_ID_TYPE})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MembershipReport{Group: grp.DN}
+	seen := make(map[string]bool)
+	var changes []*MemberResult
+	for _, member := range members {
+		entry := resolved[member]
+		if entry == nil {
+			report.add(member, "", MEMBER_STATUS_NOT_FOUND, fmt.Errorf("member not found %v", member))
+			continue
+		}
+
+		key := dnKey(entry.DN)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		// Membership of the primary group is not held in the member
+		// attribute, AD reports it as missing when removing
+		if primaryId != "" && entry.GetEqualFoldAttributeValue(PRIMARY_GROUP_ID_TYPE) == primaryId {
+			if add {
+				report.add(member, entry.DN, MEMBER_STATUS_PRESENT, nil)
+			} else {
+				report.add(member, entry.DN, MEMBER_STATUS_REJECTED, fmt.Errorf("%v is the primary group of %v", groupName, member))
+			}
+			continue
+		}
+
+		if !add && !current[key] {
+			report.add(member, entry.DN, MEMBER_STATUS_ABSENT, nil)
+			continue
+		}
+
+		status := MEMBER_STATUS_REMOVED
+		if add {
+			status = MEMBER_STATUS_ADDED
+		}
+		changes = append(changes, report.add(member, entry.DN, status, nil))
+	}
+
+	gm.applyMemberChanges(ctx, grp.DN, changes, add, ttl)
+	return report, nil
+}
@@ -0,0 +1,39 @@
+package cloudyad
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMemberOutcome(t *testing.T) {
+	result := &MemberResult{Status: MEMBER_STATUS_ADDED}
+	setMemberOutcome(result, nil, true)
+	assert.Equal(t, result.Status, MEMBER_STATUS_ADDED)
+
+	result = &MemberResult{Status: MEMBER_STATUS_ADDED}
+	setMemberOutcome(result, ldap.NewError(ldap.LDAPResultEntryAlreadyExists, errors.New("exists")), true)
+	assert.Equal(t, result.Status, MEMBER_STATUS_PRESENT)
+	assert.Nil(t, result.Err)
+
+	result = &MemberResult{Status: MEMBER_STATUS_REMOVED}
+	setMemberOutcome(result, ldap.NewError(ldap.LDAPResultNoSuchAttribute, errors.New("not a member")), false)
+	assert.Equal(t, result.Status, MEMBER_STATUS_ABSENT)
+	assert.Nil(t, result.Err)
+
+	result = &MemberResult{Status: MEMBER_STATUS_REMOVED}
+	setMemberOutcome(result, ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("no")), false)
+	assert.Equal(t, result.Status, MEMBER_STATUS_REJECTED)
+	assert.NotNil(t, result.Err)
+
+	result = &MemberResult{Status: MEMBER_STATUS_ADDED}
+	setMemberOutcome(result, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("missing")), true)
+	assert.Equal(t, result.Status, MEMBER_STATUS_NOT_FOUND)
+	assert.NotNil(t, result.Err)
+
+	result = &MemberResult{Status: MEMBER_STATUS_ADDED}
+	setMemberOutcome(result, ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("no")), true)
+	assert.Equal(t, result.Status, MEMBER_STATUS_REJECTED)
+}
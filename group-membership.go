@@ -0,0 +1,351 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/appliedres/cloudy/models"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/exp/maps"
+)
+
+// GroupMembership is a group a user belongs to, either directly or through
+// nested groups. Path holds the DNs of the groups the membership is inherited
+// through, starting with the group the user is a direct member of and ending
+// with the group itself. A direct membership has a path of one.
+type GroupMembership struct {
+	Group *models.Group
+	Path  []string
+}
+
+func (m *GroupMembership) Direct() bool {
+	return len(m.Path) == 1
+}
+
+// NestedMember is a member of a group, either directly or through nested
+// groups. Path holds the DNs of the groups from the queried group down to the
+// group that holds the member directly.
+type NestedMember struct {
+	DN   string
+	User *models.User
+	Path []string
+}
+
+func (m *NestedMember) Direct() bool {
+	return len(m.Path) == 1
+}
+
+const (
+	MEMBER_KIND_TYPE = "memberKind"
+
+	MEMBER_KIND_USER     = "user"
+	MEMBER_KIND_GROUP    = "group"
+	MEMBER_KIND_COMPUTER = "computer"
+	MEMBER_KIND_CONTACT  = "contact"
+	MEMBER_KIND_FOREIGN  = "foreignSecurityPrincipal"
+	MEMBER_KIND_UNKNOWN  = "unknown"
+)
+
+// PartialResultError is returned along with the results that could be read
+// when some of the lookups behind them failed. Failures are keyed by the DN
+// (or search base) that failed.
+type PartialResultError struct {
+	Failures map[string]error
+}
+
+func (e *PartialResultError) Error() string {
+	keys := maps.Keys(e.Failures)
+	sort.Strings(keys)
+
+	msgs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", k, e.Failures[k]))
+	}
+	return fmt.Sprintf("%d lookups failed: %v", len(keys), strings.Join(msgs, "; "))
+}
+
+func (e *PartialResultError) add(key string, err error) {
+	if e.Failures == nil {
+		e.Failures = make(map[string]error)
+	}
+	e.Failures[key] = err
+}
+
+func (e *PartialResultError) errOrNil() error {
+	if len(e.Failures) == 0 {
+		return nil
+	}
+	return e
+}
+
+// GroupMemberOptions controls how group members are returned
+type GroupMemberOptions struct {
+	// Hydrate returns fully populated members, the same as GetUser
+	Hydrate bool
+
+	// Attributes are additional attributes to read for hydrated members
+	Attributes []string
+}
+
+// memberKind tells users, groups, computers, contacts and foreign security
+// principals apart. Computers are checked first as they are also users.
+func memberKind(entry *ldap.Entry) string {
+	switch {
+	case entry == nil:
+		return MEMBER_KIND_UNKNOWN
+	case isObjectClass(entry, MEMBER_KIND_COMPUTER):
+		return MEMBER_KIND_COMPUTER
+	case isObjectClass(entry, MEMBER_KIND_USER):
+		return MEMBER_KIND_USER
+	case isObjectClass(entry, MEMBER_KIND_GROUP):
+		return MEMBER_KIND_GROUP
+	case isObjectClass(entry, MEMBER_KIND_CONTACT):
+		return MEMBER_KIND_CONTACT
+	case isObjectClass(entry, MEMBER_KIND_FOREIGN):
+		return MEMBER_KIND_FOREIGN
+	}
+	return MEMBER_KIND_UNKNOWN
+}
+
+// memberToCloudy converts a group member into a user. Members without the id
+// attribute (groups, foreign security principals, ...) use their CN as UID.
+// The entry is nil when the member could not be read.
+func (gm *AdGroupManager) memberToCloudy(dn string, entry *ldap.Entry, hydrate bool) *models.User {
+	var usr *models.User
+	switch {
+	case entry == nil:
+		usr = &models.User{}
+	case hydrate:
+		usr = entryToUser(entry, gm.cfg.UserIdAttribute, nil)
+	default:
+		id := entry.GetEqualFoldAttributeValue(gm.cfg.UserIdAttribute)
+		usr = &models.User{
+			UID:         id,
+			Username:    id,
+			DisplayName: entry.GetEqualFoldAttributeValue(DISPLAY_NAME_TYPE),
+			Email:       entry.GetEqualFoldAttributeValue(EMAIL_TYPE),
+		}
+	}
+
+	if usr.UID == "" {
+		usr.UID = rdnValue(dn)
+		usr.Username = usr.UID
+	}
+	if usr.Attributes == nil {
+		usr.Attributes = make(map[string]string)
+	}
+	usr.Attributes[DN_TYPE] = dn
+	usr.Attributes[MEMBER_KIND_TYPE] = memberKind(entry)
+	return usr
+}
+
+// GetUserGroupsTransitive returns all the groups a user belongs to including
+// the ones inherited through nested groups and the primary group. The groups
+// are found in a single search using LDAP_MATCHING_RULE_IN_CHAIN, servers that
+// do not support the rule are walked one group at a time.
+func (gm *AdGroupManager) GetUserGroupsTransitive(ctx context.Context, uid string) ([]*GroupMembership, error) {
+	user, err := gm.dir.userEntry(ctx, uid, []string{MEMBER_OF_TYPE, OBJECT_SID_TYPE, PRIMARY_GROUP_ID_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	attrs := append([]string{MEMBER_OF_TYPE}, GROUP_STANDARD_ATTRS...)
+	filter := fmt.Sprintf("(&(objectClass=group)(%v:%v:=%v))", MEMBER_TYPE, LDAP_MATCHING_RULE_IN_CHAIN, ldap.EscapeFilter(user.DN))
+	found, err := gm.dir.search(ctx, gm.dir.base, filter, attrs)
+	if err != nil && !isUnsupportedFilterError(err) {
+		return nil, err
+	}
+
+	// Groups the search did not return (all of them when the rule is not
+	// supported, the primary group and its parents otherwise) are read as
+	// the walk reaches them
+	lookup := gm.entryLookup(ctx, found, attrs)
+	parents := func(dn string) ([]string, error) {
+		entry, err := lookup(dn)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return gm.dir.allValues(ctx, entry, MEMBER_OF_TYPE)
+	}
+
+	direct, err := gm.userGroupDNs(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, order, err := walkMemberships(direct, parents)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*GroupMembership
+	for _, key := range order {
+		path := paths[key]
+		entry, err := lookup(path[len(path)-1])
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		groups = append(groups, &GroupMembership{
+			Group: entryToGroup(entry),
+			Path:  path,
+		})
+	}
+	return groups, nil
+}
+
+// GetGroupMembersTransitive returns all the members of a group including the
+// members of nested groups and the users that have one of the groups as their
+// primary group. The nested groups themselves are only used to build the
+// paths and are not returned.
+func (gm *AdGroupManager) GetGroupMembersTransitive(ctx context.Context, name string) ([]*NestedMember, error) {
+	grp, err := gm.dir.groupEntry(ctx, name, []string{MEMBER_TYPE, OBJECT_SID_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if grp == nil {
+		return nil, nil
+	}
+
+	attrs := append([]string{OBJ_CLASS_TYPE, MEMBER_OF_TYPE, OBJECT_SID_TYPE, gm.cfg.UserIdAttribute}, USER_STANDARD_ATTRS...)
+	filter := fmt.Sprintf("(%v:%v:=%v)", MEMBER_OF_TYPE, LDAP_MATCHING_RULE_IN_CHAIN, ldap.EscapeFilter(grp.DN))
+	found, err := gm.dir.search(ctx, gm.dir.base, filter, attrs)
+
+	var members func(dn string) ([]string, error)
+	var lookup func(dn string) (*ldap.Entry, error)
+	switch {
+	case err == nil:
+		children := make(map[string][]string)
+		for _, entry := range found {
+			parents, err := gm.dir.allValues(ctx, entry, MEMBER_OF_TYPE)
+			if err != nil {
+				return nil, err
+			}
+			for _, parent := range parents {
+				children[dnKey(parent)] = append(children[dnKey(parent)], entry.DN)
+			}
+		}
+
+		lookup = gm.entryLookup(ctx, append(found, grp), attrs)
+		members = func(dn string) ([]string, error) {
+			entry, err := lookup(dn)
+			if err != nil || entry == nil || !isObjectClass(entry, MEMBER_KIND_GROUP) {
+				return nil, err
+			}
+			primary, err := gm.dir.primaryGroupMembers(ctx, entry)
+			if err != nil {
+				return nil, err
+			}
+			return mergeDNs(children[dnKey(dn)], primary), nil
+		}
+	case isUnsupportedFilterError(err):
+		lookup = gm.entryLookup(ctx, nil, append([]string{MEMBER_TYPE}, attrs...))
+		members = func(dn string) ([]string, error) {
+			entry, err := lookup(dn)
+			if err != nil || entry == nil || !isObjectClass(entry, MEMBER_KIND_GROUP) {
+				return nil, err
+			}
+			return gm.groupMemberDNs(ctx, entry)
+		}
+	default:
+		return nil, err
+	}
+
+	paths, order, err := walkMemberships([]string{grp.DN}, members)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*NestedMember
+	for _, key := range order {
+		path := paths[key]
+		entry, err := lookup(path[len(path)-1])
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || key == dnKey(grp.DN) || isObjectClass(entry, MEMBER_KIND_GROUP) {
+			continue
+		}
+		results = append(results, &NestedMember{
+			DN:   entry.DN,
+			User: gm.memberToCloudy(entry.DN, entry, true),
+			Path: path[:len(path)-1],
+		})
+	}
+	return results, nil
+}
+
+// entryLookup returns a function that reads entries by DN, starting from the
+// entries that were already read and caching anything read later
+func (gm *AdGroupManager) entryLookup(ctx context.Context, known []*ldap.Entry, attrs []string) func(dn string) (*ldap.Entry, error) {
+	entries := make(map[string]*ldap.Entry)
+	for _, entry := range known {
+		entries[dnKey(entry.DN)] = entry
+	}
+
+	return func(dn string) (*ldap.Entry, error) {
+		entry, ok := entries[dnKey(dn)]
+		if ok {
+			return entry, nil
+		}
+
+		entry, err := gm.dir.entry(ctx, dn, attrs)
+		if err != nil {
+			return nil, err
+		}
+		entries[dnKey(dn)] = entry
+		return entry, nil
+	}
+}
+
+// walkMemberships walks a membership graph breadth first from the start DNs,
+// returning every reachable DN with its shortest path. Cycles end the walk.
+func walkMemberships(start []string, next func(dn string) ([]string, error)) (map[string][]string, []string, error) {
+	paths := make(map[string][]string)
+	var order []string
+	var queue []string
+
+	for _, dn := range start {
+		key := dnKey(dn)
+		if _, seen := paths[key]; seen {
+			continue
+		}
+		paths[key] = []string{dn}
+		order = append(order, key)
+		queue = append(queue, dn)
+	}
+
+	for len(queue) > 0 {
+		dn := queue[0]
+		queue = queue[1:]
+
+		nexts, err := next(dn)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, n := range nexts {
+			key := dnKey(n)
+			if _, seen := paths[key]; seen {
+				continue
+			}
+			path := append([]string{}, paths[dnKey(dn)]...)
+			paths[key] = append(path, n)
+			order = append(order, key)
+			queue = append(queue, n)
+		}
+	}
+	return paths, order, nil
+}
+
+// dnKey normalizes a DN for use as a map key. DNs are case insensitive
+func dnKey(dn string) string {
+	return strings.ToLower(dn)
+}
@@ -0,0 +1,78 @@
+package cloudyad
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkMemberships(t *testing.T) {
+	graph := map[string][]string{
+		"cn=user":   {"CN=A", "CN=B"},
+		"cn=a":      {"CN=Outer"},
+		"cn=b":      {"CN=A"},
+		"cn=outer":  {"CN=Top", "CN=B"},
+		"cn=top":    {},
+		"cn=orphan": {"CN=Top"},
+	}
+	next := func(dn string) ([]string, error) {
+		return graph[dnKey(dn)], nil
+	}
+
+	paths, order, err := walkMemberships(graph["cn=user"], next)
+	assert.Nil(t, err)
+	assert.Equal(t, order, []string{"cn=a", "cn=b", "cn=outer", "cn=top"})
+	assert.Equal(t, paths["cn=a"], []string{"CN=A"})
+	assert.Equal(t, paths["cn=b"], []string{"CN=B"})
+	assert.Equal(t, paths["cn=outer"], []string{"CN=A", "CN=Outer"})
+	assert.Equal(t, paths["cn=top"], []string{"CN=A", "CN=Outer", "CN=Top"})
+	_, ok := paths["cn=orphan"]
+	assert.False(t, ok)
+}
+
+func TestWalkMembershipsCycle(t *testing.T) {
+	graph := map[string][]string{
+		"cn=a": {"CN=B"},
+		"cn=b": {"CN=C"},
+		"cn=c": {"CN=A"},
+	}
+	calls := 0
+	next := func(dn string) ([]string, error) {
+		calls++
+		return graph[dnKey(dn)], nil
+	}
+
+	paths, order, err := walkMemberships([]string{"CN=A"}, next)
+	assert.Nil(t, err)
+	assert.Equal(t, calls, 3)
+	assert.Equal(t, order, []string{"cn=a", "cn=b", "cn=c"})
+	assert.Equal(t, paths["cn=c"], []string{"CN=A", "CN=B", "CN=C"})
+}
+
+func TestMemberKind(t *testing.T) {
+	entry := func(classes ...string) *ldap.Entry {
+		return ldap.NewEntry("CN=x,DC=test", map[string][]string{OBJ_CLASS_TYPE: classes})
+	}
+
+	assert.Equal(t, memberKind(entry("top", "person", "organizationalPerson", "user")), MEMBER_KIND_USER)
+	assert.Equal(t, memberKind(entry("top", "person", "organizationalPerson", "user", "computer")), MEMBER_KIND_COMPUTER)
+	assert.Equal(t, memberKind(entry("top", "group")), MEMBER_KIND_GROUP)
+	assert.Equal(t, memberKind(entry("top", "person", "organizationalPerson", "contact")), MEMBER_KIND_CONTACT)
+	assert.Equal(t, memberKind(entry("top", "foreignSecurityPrincipal")), MEMBER_KIND_FOREIGN)
+	assert.Equal(t, memberKind(entry("top")), MEMBER_KIND_UNKNOWN)
+	assert.Equal(t, memberKind(nil), MEMBER_KIND_UNKNOWN)
+}
+
+func TestPartialResultError(t *testing.T) {
+	partial := &PartialResultError{}
+	assert.Nil(t, partial.errOrNil())
+
+	partial.add("CN=B,DC=test", fmt.Errorf("group not found"))
+	partial.add("CN=A,DC=test", fmt.Errorf("timeout"))
+
+	err := partial.errOrNil()
+	assert.NotNil(t, err)
+	assert.Equal(t, err.Error(), "2 lookups failed: CN=A,DC=test: timeout; CN=B,DC=test: group not found")
+}
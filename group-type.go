@@ -0,0 +1,143 @@
+package cloudyad
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GroupScope is the scope portion of the AD groupType attribute
+type GroupScope uint32
+
+const (
+	GroupScopeDomainLocal GroupScope = ADS_GROUP_TYPE_DOMAIN_LOCAL_GROUP
+	GroupScopeGlobal      GroupScope = ADS_GROUP_TYPE_GLOBAL_GROUP
+	GroupScopeUniversal   GroupScope = ADS_GROUP_TYPE_UNIVERSAL_GROUP
+)
+
+const (
+	GROUP_KIND_SECURITY     = "security"
+	GROUP_KIND_DISTRIBUTION = "distribution"
+
+	GROUP_SCOPE_DOMAIN_LOCAL = "domainlocal"
+	GROUP_SCOPE_GLOBAL       = "global"
+	GROUP_SCOPE_UNIVERSAL    = "universal"
+	GROUP_SCOPE_BUILTIN      = "builtin"
+)
+
+func (s GroupScope) String() string {
+	switch s {
+	case GroupScopeDomainLocal:
+		return GROUP_SCOPE_DOMAIN_LOCAL
+	case GroupScopeGlobal:
+		return GROUP_SCOPE_GLOBAL
+	case GroupScopeUniversal:
+		return GROUP_SCOPE_UNIVERSAL
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(s))
+}
+
+// GroupType is the decoded AD groupType attribute. It is carried on
+// models.Group.Type in the form "<kind>-<scope>", e.g. "security-global" or
+// "distribution-universal".
+type GroupType struct {
+	Scope    GroupScope
+	Security bool
+	BuiltIn  bool
+}
+
+// DefaultGroupType is used when a new group does not ask for a type
+var DefaultGroupType = GroupType{Scope: GroupScopeDomainLocal, Security: true}
+
+// ParseGroupType parses the models.Group.Type convention. Either part may be
+// left off: "global" is a security group and "distribution" is domain local.
+// An empty string returns DefaultGroupType. More than one kind or scope, e.g.
+// "global-universal", is an error.
+func ParseGroupType(s string) (GroupType, error) {
+	gt := DefaultGroupType
+	if strings.TrimSpace(s) == "" {
+		return gt, nil
+	}
+
+	kinds, scopes := 0, 0
+	for _, part := range strings.Split(strings.ToLower(s), "-") {
+		switch strings.TrimSpace(part) {
+		case GROUP_KIND_SECURITY:
+			gt.Security = true
+			kinds++
+		case GROUP_KIND_DISTRIBUTION:
+			gt.Security = false
+			kinds++
+		case GROUP_SCOPE_DOMAIN_LOCAL, "local":
+			gt.Scope = GroupScopeDomainLocal
+			scopes++
+		case GROUP_SCOPE_GLOBAL:
+			gt.Scope = GroupScopeGlobal
+			scopes++
+		case GROUP_SCOPE_UNIVERSAL:
+			gt.Scope = GroupScopeUniversal
+			scopes++
+		default:
+			return gt, fmt.Errorf("invalid group type %v", s)
+		}
+	}
+	if kinds > 1 || scopes > 1 {
+		return gt, fmt.Errorf("invalid group type %v, give at most one kind and one scope", s)
+	}
+	return gt, nil
+}
+
+// DecodeGroupType decodes the raw groupType attribute value. AD stores it
+// as a signed 32 bit integer so security groups come back negative.
+func DecodeGroupType(val string) (GroupType, error) {
+	raw, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil {
+		return GroupType{}, err
+	}
+
+	bits := uint32(raw)
+	return GroupType{
+		Scope:    GroupScope(bits & (ADS_GROUP_TYPE_DOMAIN_LOCAL_GROUP | ADS_GROUP_TYPE_GLOBAL_GROUP | ADS_GROUP_TYPE_UNIVERSAL_GROUP)),
+		Security: bits&ADS_GROUP_TYPE_SECURITY_ENABLED != 0,
+		BuiltIn:  bits&ADS_GROUP_TYPE_BUILTIN_LOCAL_GROUP != 0,
+	}, nil
+}
+
+// Bits returns the groupType bit mask
+func (gt GroupType) Bits() uint32 {
+	bits := uint32(gt.Scope)
+	if gt.Security {
+		bits |= ADS_GROUP_TYPE_SECURITY_ENABLED
+	}
+	if gt.BuiltIn {
+		bits |= ADS_GROUP_TYPE_BUILTIN_LOCAL_GROUP
+	}
+	return bits
+}
+
+// LdapValue returns the value to write to the groupType attribute
+func (gt GroupType) LdapValue() string {
+	return fmt.Sprintf("%d", int32(gt.Bits()))
+}
+
+func (gt GroupType) String() string {
+	kind := GROUP_KIND_DISTRIBUTION
+	if gt.Security {
+		kind = GROUP_KIND_SECURITY
+	}
+
+	scope := gt.Scope.String()
+	if gt.BuiltIn {
+		scope = GROUP_SCOPE_BUILTIN
+	}
+	return kind + "-" + scope
+}
+
+// scopeChangeAllowed reports if AD can convert directly between two scopes.
+// Global and domain local groups have to pass through universal.
+func scopeChangeAllowed(from GroupScope, to GroupScope) bool {
+	if from == to {
+		return true
+	}
+	return from == GroupScopeUniversal || to == GroupScopeUniversal
+}
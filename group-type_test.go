@@ -0,0 +1,78 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupType(t *testing.T) {
+	gt, err := ParseGroupType("")
+	assert.Nil(t, err)
+	assert.Equal(t, gt, DefaultGroupType)
+
+	gt, err = ParseGroupType("security-global")
+	assert.Nil(t, err)
+	assert.Equal(t, gt, GroupType{Scope: GroupScopeGlobal, Security: true})
+
+	gt, err = ParseGroupType("Distribution-Universal")
+	assert.Nil(t, err)
+	assert.Equal(t, gt, GroupType{Scope: GroupScopeUniversal, Security: false})
+
+	gt, err = ParseGroupType("distribution")
+	assert.Nil(t, err)
+	assert.Equal(t, gt, GroupType{Scope: GroupScopeDomainLocal, Security: false})
+
+	_, err = ParseGroupType("security-forest")
+	assert.NotNil(t, err)
+
+	_, err = ParseGroupType("security-distribution")
+	assert.NotNil(t, err)
+	_, err = ParseGroupType("global-universal")
+	assert.NotNil(t, err)
+	_, err = ParseGroupType("security-global-local")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeGroupType(t *testing.T) {
+	gt, err := DecodeGroupType("-2147483644")
+	assert.Nil(t, err)
+	assert.Equal(t, gt.String(), "security-domainlocal")
+
+	gt, err = DecodeGroupType("-2147483646")
+	assert.Nil(t, err)
+	assert.Equal(t, gt.String(), "security-global")
+
+	gt, err = DecodeGroupType("8")
+	assert.Nil(t, err)
+	assert.Equal(t, gt.String(), "distribution-universal")
+
+	gt, err = DecodeGroupType("-2147483643")
+	assert.Nil(t, err)
+	assert.Equal(t, gt.BuiltIn, true)
+	assert.Equal(t, gt.String(), "security-builtin")
+
+	_, err = DecodeGroupType("abc")
+	assert.NotNil(t, err)
+}
+
+func TestGroupTypeLdapValue(t *testing.T) {
+	assert.Equal(t, DefaultGroupType.LdapValue(), "-2147483644")
+	assert.Equal(t, GroupType{Scope: GroupScopeGlobal}.LdapValue(), "2")
+
+	for _, s := range []string{"security-global", "security-universal", "distribution-domainlocal"} {
+		gt, err := ParseGroupType(s)
+		assert.Nil(t, err)
+
+		decoded, err := DecodeGroupType(gt.LdapValue())
+		assert.Nil(t, err)
+		assert.Equal(t, decoded, gt)
+	}
+}
+
+func TestScopeChangeAllowed(t *testing.T) {
+	assert.True(t, scopeChangeAllowed(GroupScopeGlobal, GroupScopeUniversal))
+	assert.True(t, scopeChangeAllowed(GroupScopeUniversal, GroupScopeDomainLocal))
+	assert.False(t, scopeChangeAllowed(GroupScopeGlobal, GroupScopeDomainLocal))
+	assert.False(t, scopeChangeAllowed(GroupScopeDomainLocal, GroupScopeGlobal))
+}
@@ -0,0 +1,188 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy-ad/adtime"
+)
+
+// lastLogonTimestamp is replicated but can lag 9 to 14 days, lastLogon is
+// exact but kept per domain controller
+const (
+	LAST_SIGN_IN_MODE_REPLICATED = "replicated"
+	LAST_SIGN_IN_MODE_PRECISE    = "precise"
+
+	// LAST_SIGN_IN_PRECISION_APPROXIMATE is a lastLogonTimestamp value, it
+	// may be up to msDS-LogonTimeSyncInterval behind
+	LAST_SIGN_IN_PRECISION_APPROXIMATE = "approximate"
+	// LAST_SIGN_IN_PRECISION_EXACT is the latest lastLogon of all the
+	// domain controllers
+	LAST_SIGN_IN_PRECISION_EXACT = "exact"
+	// LAST_SIGN_IN_PRECISION_PARTIAL is the latest lastLogon of the domain
+	// controllers that could be reached
+	LAST_SIGN_IN_PRECISION_PARTIAL = "partial"
+	// LAST_SIGN_IN_PRECISION_FALLBACK is a lastLogonTimestamp value given in
+	// the precise mode because no domain controller could be read, the
+	// reason is in lastSignInError
+	LAST_SIGN_IN_PRECISION_FALLBACK = "approximate-fallback"
+
+	DEFAULT_NAMING_CONTEXT_TYPE = "defaultNamingContext"
+	DNS_HOST_NAME_TYPE          = "dNSHostName"
+)
+
+// LastSignIn is the last time a user signed in and how it was worked out.
+// Time is the zero time when the user never signed in.
+type LastSignIn struct {
+	Time      time.Time
+	Source    string
+	Precision string
+
+	// DomainControllers are the domain controllers that were read in the
+	// precise mode, Failures the ones that could not be
+	DomainControllers []string
+	Failures          map[string]error
+}
+
+func includeLastSignIn(opts *cloudy.UserOptions) bool {
+	return opts != nil && opts.IncludeLastSignIn != nil && *opts.IncludeLastSignIn
+}
+
+func lastSignInFromTimestamp(val string) *LastSignIn {
+	t, _ := adtime.ParseFileTime(val)
+	return &LastSignIn{
+		Time:      t,
+		Source:    LAST_LOGON_TIMESTAMP_TYPE,
+		Precision: LAST_SIGN_IN_PRECISION_APPROXIMATE,
+	}
+}
+
+func (s *LastSignIn) setAttributes(attrs map[string]string) {
+	attrs[LAST_SIGN_IN_TYPE] = adtime.Format(s.Time)
+	attrs[LAST_SIGN_IN_SOURCE_TYPE] = s.Source
+	attrs[LAST_SIGN_IN_PRECISION_TYPE] = s.Precision
+}
+
+// GetLastSignIn returns the last time a user signed in. Without precise the
+// replicated lastLogonTimestamp is used. With precise every domain controller
+// is asked for its lastLogon, an error is only returned when none of them
+// could be read.
+func (um *AdUserManager) GetLastSignIn(ctx context.Context, uid string, precise bool) (*LastSignIn, error) {
+	entry, err := um.dir.userEntry(ctx, uid, []string{LAST_LOGON_TIMESTAMP_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("user not found %v", uid)
+	}
+
+	if !precise {
+		return lastSignInFromTimestamp(entry.GetEqualFoldAttributeValue(LAST_LOGON_TIMESTAMP_TYPE)), nil
+	}
+
+	dcs, err := um.dir.domainControllers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(dcs) == 0 {
+		return nil, fmt.Errorf("no domain controllers found")
+	}
+
+	result := &LastSignIn{Source: LAST_LOGIN_TYPE, Precision: LAST_SIGN_IN_PRECISION_EXACT}
+	for _, dc := range dcs {
+		t, err := um.lastLogonOn(ctx, dc, entry.DN)
+		if err != nil {
+			if result.Failures == nil {
+				result.Failures = make(map[string]error)
+			}
+			result.Failures[dc] = err
+			continue
+		}
+
+		result.DomainControllers = append(result.DomainControllers, dc)
+		if t.After(result.Time) {
+			result.Time = t
+		}
+	}
+
+	if len(result.DomainControllers) == 0 {
+		return nil, fmt.Errorf("lastLogon could not be read from any of %d domain controllers", len(dcs))
+	}
+	if len(result.Failures) > 0 {
+		result.Precision = LAST_SIGN_IN_PRECISION_PARTIAL
+	}
+	return result, nil
+}
+
+// lastLogonOn reads lastLogon from a single domain controller over its own
+// connection
+func (um *AdUserManager) lastLogonOn(ctx context.Context, host string, dn string) (time.Time, error) {
+	address, err := hostAddress(um.dir.address, host)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	dc := newLdapDirectory(address, um.dir.user, um.dir.pwd, um.dir.insecureTLS, um.dir.base, um.dir.idAttribute, um.dir.pageSize)
+	defer dc.close()
+
+	entry, err := dc.entry(ctx, dn, []string{LAST_LOGIN_TYPE})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if entry == nil {
+		return time.Time{}, fmt.Errorf("%v not found on %v", dn, host)
+	}
+
+	val := entry.GetEqualFoldAttributeValue(LAST_LOGIN_TYPE)
+	if val == "" {
+		return time.Time{}, nil
+	}
+	return adtime.ParseFileTime(val)
+}
+
+// domainControllers returns the host names of the domain controllers of the
+// domain, the computers with the server trust flag
+func (d *ldapDirectory) domainControllers(ctx context.Context) ([]string, error) {
+	base, err := d.domainDN(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := fmt.Sprintf("(&(objectCategory=computer)(%v:%v:=%d))", USER_ACCOUNT_CONTROL_TYPE, LDAP_MATCHING_RULE_BIT_AND, AC_SERVER_TRUST_ACCOUNT)
+	entries, err := d.search(ctx, base, filter, []string{DNS_HOST_NAME_TYPE})
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, entry := range entries {
+		host := entry.GetEqualFoldAttributeValue(DNS_HOST_NAME_TYPE)
+		if host != "" {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
+
+// hostAddress points an LDAP URL at a different host, keeping the scheme and
+// port
+func hostAddress(address string, host string) (string, error) {
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid address %v", address)
+	}
+
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else {
+		u.Host = host
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,40 @@
+package cloudyad
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostAddress(t *testing.T) {
+	address, err := hostAddress("ldaps://ad.example.com:636", "dc2.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, address, "ldaps://dc2.example.com:636")
+
+	address, err = hostAddress("ldap://ad.example.com", "dc2.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, address, "ldap://dc2.example.com")
+
+	_, err = hostAddress("ad.example.com", "dc2.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestLastSignInFromTimestamp(t *testing.T) {
+	signIn := lastSignInFromTimestamp("133000000000000000")
+	assert.Equal(t, signIn.Time, time.Date(2022, 6, 18, 4, 26, 40, 0, time.UTC))
+	assert.Equal(t, signIn.Source, LAST_LOGON_TIMESTAMP_TYPE)
+	assert.Equal(t, signIn.Precision, LAST_SIGN_IN_PRECISION_APPROXIMATE)
+
+	attrs := make(map[string]string)
+	signIn.setAttributes(attrs)
+	assert.Equal(t, attrs[LAST_SIGN_IN_TYPE], "2022-06-18T04:26:40Z")
+	assert.Equal(t, attrs[LAST_SIGN_IN_SOURCE_TYPE], LAST_LOGON_TIMESTAMP_TYPE)
+	assert.Equal(t, attrs[LAST_SIGN_IN_PRECISION_TYPE], LAST_SIGN_IN_PRECISION_APPROXIMATE)
+
+	// Never signed in
+	attrs = make(map[string]string)
+	lastSignInFromTimestamp("").setAttributes(attrs)
+	assert.Equal(t, attrs[LAST_SIGN_IN_TYPE], "")
+	assert.Equal(t, attrs[LAST_SIGN_IN_PRECISION_TYPE], LAST_SIGN_IN_PRECISION_APPROXIMATE)
+}
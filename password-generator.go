@@ -0,0 +1,267 @@
+package cloudyad
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/appliedres/cloudy/models"
+)
+
+const (
+	PASSWORD_UPPER  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	PASSWORD_LOWER  = "abcdefghijklmnopqrstuvwxyz"
+	PASSWORD_DIGITS = "0123456789"
+	// PASSWORD_GENERATOR_SYMBOLS is the part of PASSWORD_SYMBOLS that is easy
+	// to type and needs no quoting
+	PASSWORD_GENERATOR_SYMBOLS = "!@#$%^&*-_=+?.:"
+	// PASSWORD_AMBIGUOUS are the characters left out with ExcludeAmbiguous
+	PASSWORD_AMBIGUOUS = "0O1lI|.:"
+
+	DEFAULT_PASSWORD_LENGTH = 16
+	// DEFAULT_PASSPHRASE_WORDS gives a passphrase at least as strong as a
+	// random password of DEFAULT_PASSWORD_LENGTH, a word of the list adds
+	// about 9.4 bits against 6.3 for a random character
+	DEFAULT_PASSPHRASE_WORDS   = 11
+	PASSPHRASE_SEPARATOR       = "-"
+	PASSWORD_GENERATE_ATTEMPTS = 20
+)
+
+//go:embed passphrase-words.txt
+var passphraseWordList string
+
+var passphraseWords = strings.Fields(passphraseWordList)
+
+// GeneratePasswordOptions control GeneratePassword
+type GeneratePasswordOptions struct {
+	// UID is the user the password is for, the policy of the user applies
+	// and the password will not contain its names. Without it the domain
+	// policy applies.
+	UID string
+
+	// Length is the minimum length, 16 by default. The minimum length of
+	// the policy is used when that is longer.
+	Length int
+
+	// ExcludeAmbiguous leaves out characters that are easily mistaken for
+	// one another, like 0 and O or 1, l and I
+	ExcludeAmbiguous bool
+
+	// Passphrase builds the password from random words, capitalized and
+	// joined by a separator, with a digit added. Words is the number of
+	// words, 11 by default. A word adds about 9.4 bits, fewer words than
+	// the default give a weaker password than the random mode.
+	Passphrase bool
+	Words      int
+}
+
+// GeneratePassword returns a cryptographically random password that meets
+// the effective password policy and is not banned
+func (um *AdUserManager) GeneratePassword(ctx context.Context, opts *GeneratePasswordOptions) (string, error) {
+	if opts == nil {
+		opts = &GeneratePasswordOptions{}
+	}
+
+	policy, accountName, displayName, err := um.generatorPolicy(ctx, opts.UID)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < PASSWORD_GENERATE_ATTEMPTS; attempt++ {
+		pwd, err := generatePassword(policy, opts)
+		if err != nil {
+			return "", err
+		}
+		if len(checkPassword(policy, pwd, accountName, displayName)) > 0 {
+			continue
+		}
+
+		var bannedErr *PasswordError
+		err = um.checkBannedPassword(ctx, pwd)
+		if errors.As(err, &bannedErr) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return pwd, nil
+	}
+	return "", fmt.Errorf("no password meeting the policy after %d attempts", PASSWORD_GENERATE_ATTEMPTS)
+}
+
+// generatorPolicy returns the policy a generated password has to meet and
+// the names it must not contain, the domain policy without a user
+func (um *AdUserManager) generatorPolicy(ctx context.Context, uid string) (*PasswordPolicy, string, string, error) {
+	if uid == "" {
+		policy, err := um.GetPasswordPolicy(ctx)
+		return policy, "", "", err
+	}
+
+	user, err := um.dir.userEntry(ctx, uid, []string{SAM_ACCT_NAME_TYPE, DISPLAY_NAME_TYPE})
+	if err != nil {
+		return nil, "", "", err
+	}
+	if user == nil {
+		return nil, "", "", fmt.Errorf("user not found %v", uid)
+	}
+
+	policy, err := um.GetUserPasswordPolicy(ctx, uid)
+	return policy, user.GetEqualFoldAttributeValue(SAM_ACCT_NAME_TYPE), user.GetEqualFoldAttributeValue(DISPLAY_NAME_TYPE), err
+}
+
+// NewUserWithPassword creates a user with a generated password and returns
+// the password, which is not kept anywhere else. By default the user must
+// change it at the next sign in and the account stays disabled. The user is
+// deleted again when the password can not be set.
+func (um *AdUserManager) NewUserWithPassword(ctx context.Context, newUser *models.User, genOpts *GeneratePasswordOptions, setOpts *SetPasswordOptions) (*models.User, string, error) {
+	if setOpts == nil {
+		setOpts = &SetPasswordOptions{MustChange: true}
+	}
+
+	user, err := um.NewUser(ctx, newUser)
+	if err != nil {
+		return nil, "", err
+	}
+
+	opts := GeneratePasswordOptions{}
+	if genOpts != nil {
+		opts = *genOpts
+	}
+	opts.UID = user.UID
+
+	pwd, err := um.GeneratePassword(ctx, &opts)
+	if err == nil {
+		err = um.SetUserPasswordWithOptions(ctx, user.UID, pwd, setOpts)
+	}
+	if err != nil {
+		_ = um.DeleteUser(ctx, user.UID)
+		return nil, "", err
+	}
+
+	if setOpts.Enable {
+		user.Enabled = true
+	}
+	return user, pwd, nil
+}
+
+// generatePassword builds a password of at least the policy and requested
+// length with an upper case letter, a lower case letter, a digit and a symbol
+func generatePassword(policy *PasswordPolicy, opts *GeneratePasswordOptions) (string, error) {
+	length := opts.Length
+	if length <= 0 {
+		length = DEFAULT_PASSWORD_LENGTH
+	}
+	if length < policy.MinLength {
+		length = policy.MinLength
+	}
+
+	if opts.Passphrase {
+		return generatePassphrase(length, opts)
+	}
+
+	sets := []string{PASSWORD_UPPER, PASSWORD_LOWER, PASSWORD_DIGITS, PASSWORD_GENERATOR_SYMBOLS}
+	if opts.ExcludeAmbiguous {
+		for i, set := range sets {
+			sets[i] = withoutChars(set, PASSWORD_AMBIGUOUS)
+		}
+	}
+	all := strings.Join(sets, "")
+
+	pwd := make([]byte, 0, length)
+	for _, set := range sets {
+		c, err := randomChar(set)
+		if err != nil {
+			return "", err
+		}
+		pwd = append(pwd, c)
+	}
+	for len(pwd) < length {
+		c, err := randomChar(all)
+		if err != nil {
+			return "", err
+		}
+		pwd = append(pwd, c)
+	}
+
+	err := shuffle(len(pwd), func(i, j int) {
+		pwd[i], pwd[j] = pwd[j], pwd[i]
+	})
+	return string(pwd), err
+}
+
+// generatePassphrase joins capitalized random words and adds a digit to one
+// of them, more words are added until the password is long enough
+func generatePassphrase(length int, opts *GeneratePasswordOptions) (string, error) {
+	count := opts.Words
+	if count <= 0 {
+		count = DEFAULT_PASSPHRASE_WORDS
+	}
+
+	digits := PASSWORD_DIGITS
+	if opts.ExcludeAmbiguous {
+		digits = withoutChars(digits, PASSWORD_AMBIGUOUS)
+	}
+
+	var words []string
+	for len(words) < count || len(strings.Join(words, PASSPHRASE_SEPARATOR))+1 < length {
+		n, err := randomInt(len(passphraseWords))
+		if err != nil {
+			return "", err
+		}
+		word := passphraseWords[n]
+		words = append(words, strings.ToUpper(word[:1])+word[1:])
+	}
+
+	n, err := randomInt(len(words))
+	if err != nil {
+		return "", err
+	}
+	digit, err := randomChar(digits)
+	if err != nil {
+		return "", err
+	}
+	words[n] += string(digit)
+
+	return strings.Join(words, PASSPHRASE_SEPARATOR), nil
+}
+
+func withoutChars(set string, chars string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(chars, r) {
+			return -1
+		}
+		return r
+	}, set)
+}
+
+func randomInt(n int) (int, error) {
+	val, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(val.Int64()), nil
+}
+
+func randomChar(set string) (byte, error) {
+	n, err := randomInt(len(set))
+	if err != nil {
+		return 0, err
+	}
+	return set[n], nil
+}
+
+// shuffle is a Fisher-Yates shuffle with crypto/rand
+func shuffle(n int, swap func(i, j int)) error {
+	for i := n - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return err
+		}
+		swap(i, j)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package cloudyad
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 7, Complexity: true}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		pwd, err := generatePassword(policy, &GeneratePasswordOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, len(pwd), DEFAULT_PASSWORD_LENGTH)
+		assert.Equal(t, passwordCategories(pwd), 4)
+		assert.Empty(t, checkPassword(policy, pwd, "", ""))
+		assert.False(t, seen[pwd])
+		seen[pwd] = true
+	}
+
+	// The policy minimum wins over a shorter requested length
+	policy.MinLength = 20
+	pwd, err := generatePassword(policy, &GeneratePasswordOptions{Length: 8})
+	assert.Nil(t, err)
+	assert.Equal(t, len(pwd), 20)
+
+	for i := 0; i < 100; i++ {
+		pwd, err := generatePassword(policy, &GeneratePasswordOptions{ExcludeAmbiguous: true})
+		assert.Nil(t, err)
+		assert.False(t, strings.ContainsAny(pwd, PASSWORD_AMBIGUOUS))
+		assert.Equal(t, passwordCategories(pwd), 4)
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 7, Complexity: true}
+
+	for i := 0; i < 100; i++ {
+		pwd, err := generatePassword(policy, &GeneratePasswordOptions{Passphrase: true, ExcludeAmbiguous: true})
+		assert.Nil(t, err)
+		assert.Equal(t, len(strings.Split(pwd, PASSPHRASE_SEPARATOR)), DEFAULT_PASSPHRASE_WORDS)
+		assert.Equal(t, passwordCategories(pwd), 4)
+		assert.False(t, strings.ContainsAny(pwd, "01"))
+		assert.Empty(t, checkPassword(policy, pwd, "", ""))
+	}
+
+	// Words are added until the policy minimum is met
+	policy.MinLength = 60
+	pwd, err := generatePassword(policy, &GeneratePasswordOptions{Passphrase: true, Words: 2})
+	assert.Nil(t, err)
+	assert.True(t, len(pwd) >= 60)
+}
+
+func TestPassphraseEntropy(t *testing.T) {
+	chars := len(PASSWORD_UPPER + PASSWORD_LOWER + PASSWORD_DIGITS + PASSWORD_GENERATOR_SYMBOLS)
+	random := float64(DEFAULT_PASSWORD_LENGTH) * math.Log2(float64(chars))
+	passphrase := float64(DEFAULT_PASSPHRASE_WORDS) * math.Log2(float64(len(passphraseWords)))
+	assert.True(t, passphrase >= random)
+}
+
+func TestPassphraseWords(t *testing.T) {
+	assert.True(t, len(passphraseWords) >= 512)
+	seen := make(map[string]bool)
+	for _, word := range passphraseWords {
+		assert.False(t, seen[word])
+		seen[word] = true
+	}
+}
@@ -0,0 +1,169 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appliedres/cloudy-ad/adtime"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	MIN_PWD_LENGTH_TYPE             = "minPwdLength"
+	PWD_PROPERTIES_TYPE             = "pwdProperties"
+	PWD_HISTORY_LENGTH_TYPE         = "pwdHistoryLength"
+	MAX_PWD_AGE_TYPE                = "maxPwdAge"
+	MIN_PWD_AGE_TYPE                = "minPwdAge"
+	LOCKOUT_THRESHOLD_TYPE          = "lockoutThreshold"
+	LOCKOUT_DURATION_TYPE           = "lockoutDuration"
+	LOCKOUT_OBSERVATION_WINDOW_TYPE = "lockOutObservationWindow"
+
+	RESULTANT_PSO_TYPE                  = "msDS-ResultantPSO"
+	PSO_PRECEDENCE_TYPE                 = "msDS-PasswordSettingsPrecedence"
+	PSO_MIN_PWD_LENGTH_TYPE             = "msDS-MinimumPasswordLength"
+	PSO_COMPLEXITY_TYPE                 = "msDS-PasswordComplexityEnabled"
+	PSO_REVERSIBLE_ENCRYPTION_TYPE      = "msDS-PasswordReversibleEncryptionEnabled"
+	PSO_PWD_HISTORY_LENGTH_TYPE         = "msDS-PasswordHistoryLength"
+	PSO_MAX_PWD_AGE_TYPE                = "msDS-MaximumPasswordAge"
+	PSO_MIN_PWD_AGE_TYPE                = "msDS-MinimumPasswordAge"
+	PSO_LOCKOUT_THRESHOLD_TYPE          = "msDS-LockoutThreshold"
+	PSO_LOCKOUT_DURATION_TYPE           = "msDS-LockoutDuration"
+	PSO_LOCKOUT_OBSERVATION_WINDOW_TYPE = "msDS-LockoutObservationWindow"
+)
+
+// pwdProperties flags
+const (
+	DOMAIN_PASSWORD_COMPLEX         = 0x01
+	DOMAIN_PASSWORD_NO_ANON_CHANGE  = 0x02
+	DOMAIN_PASSWORD_NO_CLEAR_CHANGE = 0x04
+	DOMAIN_LOCKOUT_ADMINS           = 0x08
+	DOMAIN_PASSWORD_STORE_CLEARTEXT = 0x10
+	DOMAIN_REFUSE_PASSWORD_CHANGE   = 0x20
+)
+
+var DOMAIN_POLICY_ATTRS = []string{MIN_PWD_LENGTH_TYPE, PWD_PROPERTIES_TYPE, PWD_HISTORY_LENGTH_TYPE, MAX_PWD_AGE_TYPE, MIN_PWD_AGE_TYPE,
+	LOCKOUT_THRESHOLD_TYPE, LOCKOUT_DURATION_TYPE, LOCKOUT_OBSERVATION_WINDOW_TYPE}
+var PSO_POLICY_ATTRS = []string{PSO_PRECEDENCE_TYPE, PSO_MIN_PWD_LENGTH_TYPE, PSO_COMPLEXITY_TYPE, PSO_REVERSIBLE_ENCRYPTION_TYPE,
+	PSO_PWD_HISTORY_LENGTH_TYPE, PSO_MAX_PWD_AGE_TYPE, PSO_MIN_PWD_AGE_TYPE, PSO_LOCKOUT_THRESHOLD_TYPE, PSO_LOCKOUT_DURATION_TYPE,
+	PSO_LOCKOUT_OBSERVATION_WINDOW_TYPE}
+
+// PasswordPolicy is a password and lockout policy. Zero durations mean no
+// limit: MaxAge 0 never expires a password, LockoutThreshold 0 never locks an
+// account and LockoutDuration 0 keeps it locked until an admin unlocks it.
+type PasswordPolicy struct {
+	// Source is the DN of the domain or of the password settings object
+	Source      string
+	FineGrained bool
+	Precedence  int
+
+	MinLength            int
+	Complexity           bool
+	ReversibleEncryption bool
+	HistoryLength        int
+	MaxAge               time.Duration
+	MinAge               time.Duration
+
+	LockoutThreshold         int
+	LockoutDuration          time.Duration
+	LockoutObservationWindow time.Duration
+}
+
+// GetPasswordPolicy returns the password and lockout policy of the domain
+func (um *AdUserManager) GetPasswordPolicy(ctx context.Context) (*PasswordPolicy, error) {
+	dn, err := um.dir.domainDN(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := um.dir.entry(ctx, dn, DOMAIN_POLICY_ATTRS)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("domain not found %v", dn)
+	}
+	return domainPasswordPolicy(entry), nil
+}
+
+// GetUserPasswordPolicy returns the policy that applies to a user, the
+// resultant fine-grained policy when there is one and the domain policy
+// otherwise. Reading a password settings object needs more than the default
+// rights, an error is returned when it can not be read.
+func (um *AdUserManager) GetUserPasswordPolicy(ctx context.Context, uid string) (*PasswordPolicy, error) {
+	user, err := um.dir.userEntry(ctx, uid, []string{DN_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user not found %v", uid)
+	}
+
+	// msDS-ResultantPSO is constructed and only returned on a base search
+	user, err = um.dir.entry(ctx, user.DN, []string{RESULTANT_PSO_TYPE})
+	if err != nil {
+		return nil, err
+	}
+
+	pso := ""
+	if user != nil {
+		pso = user.GetEqualFoldAttributeValue(RESULTANT_PSO_TYPE)
+	}
+	if pso == "" {
+		return um.GetPasswordPolicy(ctx)
+	}
+
+	entry, err := um.dir.entry(ctx, pso, PSO_POLICY_ATTRS)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("password settings object %v of %v can not be read", pso, uid)
+	}
+	return psoPasswordPolicy(entry), nil
+}
+
+func domainPasswordPolicy(entry *ldap.Entry) *PasswordPolicy {
+	props := entryInt(entry, PWD_PROPERTIES_TYPE)
+	return &PasswordPolicy{
+		Source:                   entry.DN,
+		MinLength:                entryInt(entry, MIN_PWD_LENGTH_TYPE),
+		Complexity:               props&DOMAIN_PASSWORD_COMPLEX != 0,
+		ReversibleEncryption:     props&DOMAIN_PASSWORD_STORE_CLEARTEXT != 0,
+		HistoryLength:            entryInt(entry, PWD_HISTORY_LENGTH_TYPE),
+		MaxAge:                   entryInterval(entry, MAX_PWD_AGE_TYPE),
+		MinAge:                   entryInterval(entry, MIN_PWD_AGE_TYPE),
+		LockoutThreshold:         entryInt(entry, LOCKOUT_THRESHOLD_TYPE),
+		LockoutDuration:          entryInterval(entry, LOCKOUT_DURATION_TYPE),
+		LockoutObservationWindow: entryInterval(entry, LOCKOUT_OBSERVATION_WINDOW_TYPE),
+	}
+}
+
+func psoPasswordPolicy(entry *ldap.Entry) *PasswordPolicy {
+	return &PasswordPolicy{
+		Source:                   entry.DN,
+		FineGrained:              true,
+		Precedence:               entryInt(entry, PSO_PRECEDENCE_TYPE),
+		MinLength:                entryInt(entry, PSO_MIN_PWD_LENGTH_TYPE),
+		Complexity:               strings.EqualFold(entry.GetEqualFoldAttributeValue(PSO_COMPLEXITY_TYPE), "TRUE"),
+		ReversibleEncryption:     strings.EqualFold(entry.GetEqualFoldAttributeValue(PSO_REVERSIBLE_ENCRYPTION_TYPE), "TRUE"),
+		HistoryLength:            entryInt(entry, PSO_PWD_HISTORY_LENGTH_TYPE),
+		MaxAge:                   entryInterval(entry, PSO_MAX_PWD_AGE_TYPE),
+		MinAge:                   entryInterval(entry, PSO_MIN_PWD_AGE_TYPE),
+		LockoutThreshold:         entryInt(entry, PSO_LOCKOUT_THRESHOLD_TYPE),
+		LockoutDuration:          entryInterval(entry, PSO_LOCKOUT_DURATION_TYPE),
+		LockoutObservationWindow: entryInterval(entry, PSO_LOCKOUT_OBSERVATION_WINDOW_TYPE),
+	}
+}
+
+func entryInt(entry *ldap.Entry, attr string) int {
+	val, _ := strconv.Atoi(entry.GetEqualFoldAttributeValue(attr))
+	return val
+}
+
+func entryInterval(entry *ldap.Entry, attr string) time.Duration {
+	val, _ := adtime.ParseInterval(entry.GetEqualFoldAttributeValue(attr))
+	return val
+}
@@ -0,0 +1,61 @@
+package cloudyad
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainPasswordPolicy(t *testing.T) {
+	entry := ldap.NewEntry("DC=ldap,DC=schneide,DC=dev", map[string][]string{
+		MIN_PWD_LENGTH_TYPE:             {"7"},
+		PWD_PROPERTIES_TYPE:             {"1"},
+		PWD_HISTORY_LENGTH_TYPE:         {"24"},
+		MAX_PWD_AGE_TYPE:                {"-36288000000000"},
+		MIN_PWD_AGE_TYPE:                {"-864000000000"},
+		LOCKOUT_THRESHOLD_TYPE:          {"0"},
+		LOCKOUT_DURATION_TYPE:           {"-9223372036854775808"},
+		LOCKOUT_OBSERVATION_WINDOW_TYPE: {"-18000000000"},
+	})
+
+	policy := domainPasswordPolicy(entry)
+	assert.Equal(t, policy.Source, "DC=ldap,DC=schneide,DC=dev")
+	assert.False(t, policy.FineGrained)
+	assert.Equal(t, policy.MinLength, 7)
+	assert.True(t, policy.Complexity)
+	assert.False(t, policy.ReversibleEncryption)
+	assert.Equal(t, policy.HistoryLength, 24)
+	assert.Equal(t, policy.MaxAge, 42*24*time.Hour)
+	assert.Equal(t, policy.MinAge, 24*time.Hour)
+	assert.Equal(t, policy.LockoutThreshold, 0)
+	assert.Equal(t, policy.LockoutDuration, time.Duration(0))
+	assert.Equal(t, policy.LockoutObservationWindow, 30*time.Minute)
+}
+
+func TestPSOPasswordPolicy(t *testing.T) {
+	entry := ldap.NewEntry("CN=Admins,CN=Password Settings Container,CN=System,DC=ldap,DC=schneide,DC=dev", map[string][]string{
+		PSO_PRECEDENCE_TYPE:                 {"10"},
+		PSO_MIN_PWD_LENGTH_TYPE:             {"15"},
+		PSO_COMPLEXITY_TYPE:                 {"TRUE"},
+		PSO_REVERSIBLE_ENCRYPTION_TYPE:      {"FALSE"},
+		PSO_PWD_HISTORY_LENGTH_TYPE:         {"48"},
+		PSO_MAX_PWD_AGE_TYPE:                {"-9223372036854775808"},
+		PSO_LOCKOUT_THRESHOLD_TYPE:          {"5"},
+		PSO_LOCKOUT_DURATION_TYPE:           {"-18000000000"},
+		PSO_LOCKOUT_OBSERVATION_WINDOW_TYPE: {"-18000000000"},
+	})
+
+	policy := psoPasswordPolicy(entry)
+	assert.True(t, policy.FineGrained)
+	assert.Equal(t, policy.Precedence, 10)
+	assert.Equal(t, policy.MinLength, 15)
+	assert.True(t, policy.Complexity)
+	assert.False(t, policy.ReversibleEncryption)
+	assert.Equal(t, policy.HistoryLength, 48)
+	assert.Equal(t, policy.MaxAge, time.Duration(0))
+	assert.Equal(t, policy.MinAge, time.Duration(0))
+	assert.Equal(t, policy.LockoutThreshold, 5)
+	assert.Equal(t, policy.LockoutDuration, 30*time.Minute)
+}
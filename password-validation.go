@@ -0,0 +1,123 @@
+package cloudyad
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const PASSWORD_SYMBOLS = "~!@#$%^&*_-+=`|\\(){}[]:;\"'<>,.?/"
+const PASSWORD_MIN_CATEGORIES = 3
+const PASSWORD_MIN_TOKEN_LENGTH = 3
+
+const displayNameDelimiters = ",.-_ #\t"
+
+// ValidatePassword checks a candidate password against the effective policy of
+// a user, following the length and complexity rules AD documents. A password
+// that breaks the policy gives a *PasswordError with the rules it broke in
+// Violations. The history and minimum age are only checked by AD itself.
+func (um *AdUserManager) ValidatePassword(ctx context.Context, uid string, candidate string) error {
+	user, err := um.dir.userEntry(ctx, uid, []string{SAM_ACCT_NAME_TYPE, DISPLAY_NAME_TYPE})
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	policy, err := um.GetUserPasswordPolicy(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	violations := checkPassword(policy, candidate, user.GetEqualFoldAttributeValue(SAM_ACCT_NAME_TYPE), user.GetEqualFoldAttributeValue(DISPLAY_NAME_TYPE))
+
+	var bannedErr *PasswordError
+	err = um.checkBannedPassword(ctx, candidate)
+	if errors.As(err, &bannedErr) {
+		violations = append(violations, bannedErr.Violations...)
+	} else if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PasswordError{
+		Code:       ERROR_PASSWORD_RESTRICTION,
+		Message:    strings.Join(violations, " "),
+		Violations: violations,
+	}
+}
+
+// checkPassword returns the rules of the policy a password breaks
+func checkPassword(policy *PasswordPolicy, pwd string, accountName string, displayName string) []string {
+	var violations []string
+	if utf8.RuneCountInString(pwd) < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("The password must be at least %d characters long.", policy.MinLength))
+	}
+
+	if !policy.Complexity {
+		return violations
+	}
+
+	lower := strings.ToLower(pwd)
+	if utf8.RuneCountInString(accountName) >= PASSWORD_MIN_TOKEN_LENGTH && strings.Contains(lower, strings.ToLower(accountName)) {
+		violations = append(violations, "The password must not contain the account name.")
+	}
+
+	for _, token := range displayNameTokens(displayName) {
+		if strings.Contains(lower, strings.ToLower(token)) {
+			violations = append(violations, "The password must not contain parts of the full name.")
+			break
+		}
+	}
+
+	if passwordCategories(pwd) < PASSWORD_MIN_CATEGORIES {
+		violations = append(violations, fmt.Sprintf("The password must use %d of: upper case letters, lower case letters, digits and symbols.", PASSWORD_MIN_CATEGORIES))
+	}
+	return violations
+}
+
+// displayNameTokens splits a display name the way AD does for the complexity
+// check, tokens shorter than 3 characters are left out
+func displayNameTokens(displayName string) []string {
+	var tokens []string
+	for _, token := range strings.FieldsFunc(displayName, func(r rune) bool {
+		return strings.ContainsRune(displayNameDelimiters, r)
+	}) {
+		if utf8.RuneCountInString(token) >= PASSWORD_MIN_TOKEN_LENGTH {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// passwordCategories counts the complexity categories a password uses
+func passwordCategories(pwd string) int {
+	var upper, lower, digit, symbol, other bool
+	for _, r := range pwd {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case strings.ContainsRune(PASSWORD_SYMBOLS, r):
+			symbol = true
+		case unicode.IsLetter(r):
+			other = true
+		}
+	}
+
+	count := 0
+	for _, used := range []bool{upper, lower, digit, symbol, other} {
+		if used {
+			count++
+		}
+	}
+	return count
+}
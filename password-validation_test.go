@@ -0,0 +1,48 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordCategories(t *testing.T) {
+	assert.Equal(t, passwordCategories("password"), 1)
+	assert.Equal(t, passwordCategories("Password"), 2)
+	assert.Equal(t, passwordCategories("Password1"), 3)
+	assert.Equal(t, passwordCategories("Password1!"), 4)
+	assert.Equal(t, passwordCategories("Pässwörd"), 2)
+	assert.Equal(t, passwordCategories("密码password1"), 3)
+	assert.Equal(t, passwordCategories("١٢٣abc"), 1)
+	assert.Equal(t, passwordCategories("€€€abc1"), 2)
+}
+
+func TestDisplayNameTokens(t *testing.T) {
+	assert.Equal(t, displayNameTokens("Erin M. Hagens"), []string{"Erin", "Hagens"})
+	assert.Equal(t, displayNameTokens("Hagens,Erin-Jo_Marie#x\tIV"), []string{"Hagens", "Erin", "Marie"})
+	assert.Nil(t, displayNameTokens(""))
+}
+
+func TestCheckPassword(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 7, Complexity: true}
+
+	assert.Empty(t, checkPassword(policy, "W!SjA-as44", "ehagens", "Erin M. Hagens"))
+
+	violations := checkPassword(policy, "abc", "ehagens", "Erin M. Hagens")
+	assert.Equal(t, len(violations), 2)
+	assert.Contains(t, violations[0], "at least 7 characters")
+
+	violations = checkPassword(policy, "xEHAGENS1!", "ehagens", "Erin M. Hagens")
+	assert.Equal(t, violations, []string{"The password must not contain the account name.", "The password must not contain parts of the full name."})
+
+	violations = checkPassword(policy, "MyErin4Ever", "ehagens", "Erin M. Hagens")
+	assert.Equal(t, violations, []string{"The password must not contain parts of the full name."})
+
+	// Short account names and name tokens are not checked
+	assert.Empty(t, checkPassword(policy, "Jo!Ed-2024", "jo", "Jo Ed"))
+
+	// Without complexity only the length is checked
+	policy.Complexity = false
+	assert.Empty(t, checkPassword(policy, "ehagens", "ehagens", "Erin M. Hagens"))
+	assert.NotEmpty(t, checkPassword(policy, "short", "ehagens", "Erin M. Hagens"))
+}
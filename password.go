@@ -0,0 +1,236 @@
+package cloudyad
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// pwdLastSet can only be written as 0, the password has expired and must be
+// changed at the next sign in, or -1, AD sets it to the current time
+const (
+	PWD_LAST_SET_EXPIRED = "0"
+	PWD_LAST_SET_NOW     = "-1"
+)
+
+// Win32 error codes AD puts at the start of the diagnostic message of a
+// failed password change
+const (
+	ERROR_ACCESS_DENIED        = 0x5
+	ERROR_INVALID_PASSWORD     = 0x56
+	ERROR_PASSWORD_RESTRICTION = 0x52D
+	ERROR_LOGON_FAILURE        = 0x52E
+	ERROR_ACCOUNT_RESTRICTION  = 0x52F
+	ERROR_PASSWORD_EXPIRED     = 0x532
+	ERROR_ACCOUNT_DISABLED     = 0x533
+	ERROR_ACCOUNT_EXPIRED      = 0x701
+	ERROR_PASSWORD_MUST_CHANGE = 0x773
+	ERROR_ACCOUNT_LOCKED_OUT   = 0x775
+)
+
+var passwordErrorMessages = map[uint32]string{
+	ERROR_ACCESS_DENIED:        "You are not allowed to change this password",
+	ERROR_INVALID_PASSWORD:     "The current password is incorrect",
+	ERROR_PASSWORD_RESTRICTION: "The new password does not meet the length, complexity, history or minimum age requirements",
+	ERROR_LOGON_FAILURE:        "The current password is incorrect",
+	ERROR_ACCOUNT_RESTRICTION:  "The account is restricted",
+	ERROR_PASSWORD_EXPIRED:     "The password has expired",
+	ERROR_ACCOUNT_DISABLED:     "The account is disabled",
+	ERROR_ACCOUNT_EXPIRED:      "The account has expired",
+	ERROR_PASSWORD_MUST_CHANGE: "The password must be changed",
+	ERROR_ACCOUNT_LOCKED_OUT:   "The account is locked out",
+}
+
+// PasswordError is a password change or reset AD refused. The error message
+// can be shown to the user, the LDAP error with the diagnostic is in Err.
+type PasswordError struct {
+	Code    uint32
+	Message string
+	Err     error
+
+	// Violations are the rules a password broke when it was checked by
+	// ValidatePassword, Err is nil then
+	Violations []string
+}
+
+func (e *PasswordError) Error() string {
+	return e.Message
+}
+
+func (e *PasswordError) Unwrap() error {
+	return e.Err
+}
+
+// SetPasswordOptions control an admin password reset. Without MustChange or
+// ExpireNow the password is good for the maximum password age of the domain.
+type SetPasswordOptions struct {
+	// MustChange makes the user change the password at the next sign in
+	MustChange bool
+	// ClearMustChange clears a pending must change and restarts the maximum
+	// password age from now
+	ClearMustChange bool
+	// ExpireNow expires the new password right away. AD keeps this the same
+	// way as MustChange, the user has to change it at the next sign in.
+	ExpireNow bool
+	// Enable enables the account along with the reset
+	Enable bool
+}
+
+// pwdLastSet returns the pwdLastSet value the options write along with the
+// password, empty when they leave it to AD
+func (opts *SetPasswordOptions) pwdLastSet() (string, error) {
+	switch {
+	case opts.ClearMustChange && (opts.MustChange || opts.ExpireNow):
+		return "", fmt.Errorf("ClearMustChange can not be combined with MustChange or ExpireNow")
+	case opts.ClearMustChange:
+		return PWD_LAST_SET_NOW, nil
+	case opts.MustChange || opts.ExpireNow:
+		return PWD_LAST_SET_EXPIRED, nil
+	}
+	return "", nil
+}
+
+// SetUserPasswordWithOptions resets the password of a user and unlocks the
+// account. The password, pwdLastSet, lockoutTime and userAccountControl are
+// written in a single modify so either all of them change or none do. A
+// banned password is rejected before anything is written.
+func (um *AdUserManager) SetUserPasswordWithOptions(ctx context.Context, uid string, pwd string, opts *SetPasswordOptions) error {
+	if opts == nil {
+		opts = &SetPasswordOptions{}
+	}
+	pwdLastSet, err := opts.pwdLastSet()
+	if err != nil {
+		return err
+	}
+
+	err = um.checkBannedPassword(ctx, pwd)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < UAC_UPDATE_ATTEMPTS; attempt++ {
+		entry, err := um.dir.userEntry(ctx, uid, []string{USER_ACCOUNT_CONTROL_TYPE})
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return fmt.Errorf("user not found %v", uid)
+		}
+
+		req := ldap.NewModifyRequest(entry.DN, nil)
+		req.Replace(UNICODE_PWD_TYPE, []string{encodePassword(pwd)})
+		if pwdLastSet != "" {
+			req.Replace(PASSWORD_LAST_SET, []string{pwdLastSet})
+		}
+		req.Replace(LOCKOUT_TIME_TYPE, []string{"0"})
+
+		if opts.Enable {
+			old := entry.GetEqualFoldAttributeValue(USER_ACCOUNT_CONTROL_TYPE)
+			current, err := strconv.ParseInt(old, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %v %v on %v", USER_ACCOUNT_CONTROL_TYPE, old, uid)
+			}
+			if current&AC_ACCOUNTDISABLE != 0 {
+				req.Delete(USER_ACCOUNT_CONTROL_TYPE, []string{old})
+				req.Add(USER_ACCOUNT_CONTROL_TYPE, []string{strconv.FormatInt(int64(int32(uint32(current)&^AC_ACCOUNTDISABLE)), 10)})
+			}
+		}
+
+		err = um.dir.modify(ctx, req)
+		if opts.Enable && ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+			continue
+		}
+		return decodePasswordError(err)
+	}
+	return fmt.Errorf("%v of %v changed during %d update attempts", USER_ACCOUNT_CONTROL_TYPE, uid, UAC_UPDATE_ATTEMPTS)
+}
+
+// ExpirePassword expires the password of a user right away, the user has to
+// change it at the next sign in
+func (um *AdUserManager) ExpirePassword(ctx context.Context, uid string) error {
+	return um.setPwdLastSet(ctx, uid, PWD_LAST_SET_EXPIRED)
+}
+
+// ResetPasswordClock clears a pending must change and restarts the maximum
+// password age from now, without changing the password
+func (um *AdUserManager) ResetPasswordClock(ctx context.Context, uid string) error {
+	return um.setPwdLastSet(ctx, uid, PWD_LAST_SET_NOW)
+}
+
+func (um *AdUserManager) setPwdLastSet(ctx context.Context, uid string, val string) error {
+	entry, err := um.dir.userEntry(ctx, uid, []string{PASSWORD_LAST_SET})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Replace(PASSWORD_LAST_SET, []string{val})
+	return um.dir.modify(ctx, req)
+}
+
+// ChangeUserPassword changes the password of a user the way the user would,
+// the old password has to be right and the password policy applies. Policy
+// violations and banned passwords are returned as a *PasswordError.
+func (um *AdUserManager) ChangeUserPassword(ctx context.Context, uid string, oldPwd string, newPwd string) error {
+	err := um.checkBannedPassword(ctx, newPwd)
+	if err != nil {
+		return err
+	}
+
+	entry, err := um.dir.userEntry(ctx, uid, []string{DN_TYPE})
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	req.Delete(UNICODE_PWD_TYPE, []string{encodePassword(oldPwd)})
+	req.Add(UNICODE_PWD_TYPE, []string{encodePassword(newPwd)})
+	return decodePasswordError(um.dir.modify(ctx, req))
+}
+
+// encodePassword returns a password as a unicodePwd value, in double quotes
+// encoded as UTF-16LE
+func encodePassword(pwd string) string {
+	chars := utf16.Encode([]rune("\"" + pwd + "\""))
+	buf := make([]byte, len(chars)*2)
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(buf[i*2:], c)
+	}
+	return string(buf)
+}
+
+// decodePasswordError turns the LDAP error of a password write into a
+// *PasswordError when AD gave a reason, e.g.
+// "0000052D: Constraint violation - check_password_restrictions: ..."
+func decodePasswordError(err error) error {
+	var ldapErr *ldap.Error
+	if err == nil || !errors.As(err, &ldapErr) || ldapErr.Err == nil {
+		return err
+	}
+
+	diag := ldapErr.Err.Error()
+	if len(diag) < 9 || diag[8] != ':' {
+		return err
+	}
+	code, parseErr := strconv.ParseUint(diag[:8], 16, 32)
+	if parseErr != nil {
+		return err
+	}
+
+	msg, ok := passwordErrorMessages[uint32(code)]
+	if !ok {
+		return err
+	}
+	return &PasswordError{Code: uint32(code), Message: msg, Err: err}
+}
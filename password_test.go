@@ -0,0 +1,62 @@
+package cloudyad
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodePassword(t *testing.T) {
+	assert.Equal(t, encodePassword("ab"), "\"\x00a\x00b\x00\"\x00")
+	assert.Equal(t, encodePassword("é"), "\"\x00\xe9\x00\"\x00")
+	assert.Equal(t, len(encodePassword("😀")), 8)
+}
+
+func TestSetPasswordOptionsPwdLastSet(t *testing.T) {
+	val, err := (&SetPasswordOptions{}).pwdLastSet()
+	assert.Nil(t, err)
+	assert.Equal(t, val, "")
+
+	val, err = (&SetPasswordOptions{MustChange: true}).pwdLastSet()
+	assert.Nil(t, err)
+	assert.Equal(t, val, PWD_LAST_SET_EXPIRED)
+
+	val, err = (&SetPasswordOptions{ExpireNow: true}).pwdLastSet()
+	assert.Nil(t, err)
+	assert.Equal(t, val, PWD_LAST_SET_EXPIRED)
+
+	val, err = (&SetPasswordOptions{ClearMustChange: true}).pwdLastSet()
+	assert.Nil(t, err)
+	assert.Equal(t, val, PWD_LAST_SET_NOW)
+
+	_, err = (&SetPasswordOptions{ClearMustChange: true, MustChange: true}).pwdLastSet()
+	assert.NotNil(t, err)
+	_, err = (&SetPasswordOptions{ClearMustChange: true, ExpireNow: true}).pwdLastSet()
+	assert.NotNil(t, err)
+}
+
+func TestDecodePasswordError(t *testing.T) {
+	assert.Nil(t, decodePasswordError(nil))
+
+	err := ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("0000052D: Constraint violation - check_password_restrictions: the password is too short"))
+	decoded := decodePasswordError(err)
+	var pwdErr *PasswordError
+	assert.True(t, errors.As(decoded, &pwdErr))
+	assert.Equal(t, pwdErr.Code, uint32(ERROR_PASSWORD_RESTRICTION))
+	assert.True(t, ldap.IsErrorWithCode(decoded, ldap.LDAPResultConstraintViolation))
+
+	err = ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("00000056: AtrErr: DSID-03190F80, #1:"))
+	decoded = decodePasswordError(fmt.Errorf("wrapped: %w", err))
+	assert.True(t, errors.As(decoded, &pwdErr))
+	assert.Equal(t, pwdErr.Code, uint32(ERROR_INVALID_PASSWORD))
+	assert.Equal(t, decoded.Error(), "The current password is incorrect")
+
+	// Unknown codes and other errors are left alone
+	err = ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("0000001F: SvcErr: DSID-031A12D2, problem 5003"))
+	assert.Equal(t, decodePasswordError(err), err)
+	err = errors.New("connection reset")
+	assert.Equal(t, decodePasswordError(err), err)
+}
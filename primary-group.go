@@ -0,0 +1,189 @@
+package cloudyad
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// primaryGroupEntry returns the primary group of a user, which AD only records
+// in its primaryGroupID. The user entry must have been read with objectSid
+// and primaryGroupID.
+func (d *ldapDirectory) primaryGroupEntry(ctx context.Context, user *ldap.Entry, attrs []string) (*ldap.Entry, error) {
+	rid := user.GetEqualFoldAttributeValue(PRIMARY_GROUP_ID_TYPE)
+	if rid == "" {
+		return nil, nil
+	}
+
+	sid, err := DecodeSID(user.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	if err != nil {
+		return nil, err
+	}
+	domain, _, err := splitSID(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.sidEntry(ctx, domain+"-"+rid, attrs)
+}
+
+// primaryGroupMembers returns the DNs of the users that have the group as
+// their primary group. The group entry must have been read with objectSid.
+func (d *ldapDirectory) primaryGroupMembers(ctx context.Context, group *ldap.Entry) ([]string, error) {
+	sid, err := DecodeSID(group.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	if err != nil {
+		return nil, err
+	}
+
+	// Builtin and well known groups can not be a primary group
+	if !strings.HasPrefix(sid, DOMAIN_SID_PREFIX) {
+		return nil, nil
+	}
+
+	_, rid, err := splitSID(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := d.search(ctx, d.base, fmt.Sprintf("(%v=%d)", PRIMARY_GROUP_ID_TYPE, rid), []string{DN_TYPE})
+	if err != nil {
+		return nil, err
+	}
+
+	var dns []string
+	for _, entry := range entries {
+		dns = append(dns, entry.DN)
+	}
+	return dns, nil
+}
+
+// userGroupDNs returns the DNs of the groups a user is a direct member of,
+// including the primary group. The user entry must have been read with
+// memberOf, objectSid and primaryGroupID.
+func (gm *AdGroupManager) userGroupDNs(ctx context.Context, user *ldap.Entry) ([]string, error) {
+	dns, err := gm.dir.allValues(ctx, user, MEMBER_OF_TYPE)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := gm.dir.primaryGroupEntry(ctx, user, []string{DN_TYPE})
+	if err != nil {
+		return nil, err
+	}
+	if primary != nil {
+		dns = mergeDNs(dns, []string{primary.DN})
+	}
+	return dns, nil
+}
+
+// groupMemberDNs returns the DNs of the direct members of a group, including
+// the users that have it as their primary group. The group entry must have
+// been read with member and objectSid.
+func (gm *AdGroupManager) groupMemberDNs(ctx context.Context, grp *ldap.Entry) ([]string, error) {
+	dns, err := gm.dir.allValues(ctx, grp, MEMBER_TYPE)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := gm.dir.primaryGroupMembers(ctx, grp)
+	if err != nil {
+		return nil, err
+	}
+	return mergeDNs(dns, primary), nil
+}
+
+// mergeDNs appends the extra DNs that are not already in the list
+func mergeDNs(dns []string, extra []string) []string {
+	if len(extra) == 0 {
+		return dns
+	}
+
+	seen := make(map[string]bool)
+	for _, dn := range dns {
+		seen[dnKey(dn)] = true
+	}
+	for _, dn := range extra {
+		if !seen[dnKey(dn)] {
+			seen[dnKey(dn)] = true
+			dns = append(dns, dn)
+		}
+	}
+	return dns
+}
+
+// sidEntry finds an object by its SID
+func (d *ldapDirectory) sidEntry(ctx context.Context, sid string, attrs []string) (*ldap.Entry, error) {
+	val, err := sidFilterValue(sid)
+	if err != nil {
+		return nil, err
+	}
+	return d.findOne(ctx, fmt.Sprintf("(%v=%v)", OBJECT_SID_TYPE, val), attrs)
+}
+
+// SetPrimaryGroup makes a group the primary group of a user. The user must
+// already be a member of the group. AD keeps the previous primary group as a
+// regular membership.
+func (gm *AdGroupManager) SetPrimaryGroup(ctx context.Context, uid string, groupName string) error {
+	user, err := gm.dir.userEntry(ctx, uid, []string{MEMBER_OF_TYPE, OBJECT_SID_TYPE, PRIMARY_GROUP_ID_TYPE})
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
+
+	grp, err := gm.dir.groupEntry(ctx, groupName, []string{OBJECT_SID_TYPE})
+	if err != nil {
+		return err
+	}
+	if grp == nil {
+		return fmt.Errorf("group not found %v", groupName)
+	}
+
+	userSID, err := DecodeSID(user.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	if err != nil {
+		return err
+	}
+	groupSID, err := DecodeSID(grp.GetEqualFoldRawAttributeValue(OBJECT_SID_TYPE))
+	if err != nil {
+		return err
+	}
+
+	userDomain, _, err := splitSID(userSID)
+	if err != nil {
+		return err
+	}
+	groupDomain, rid, err := splitSID(groupSID)
+	if err != nil {
+		return err
+	}
+	if userDomain != groupDomain {
+		return fmt.Errorf("group %v is not in the domain of user %v", groupName, uid)
+	}
+
+	if user.GetEqualFoldAttributeValue(PRIMARY_GROUP_ID_TYPE) == strconv.FormatUint(uint64(rid), 10) {
+		return nil
+	}
+
+	memberOf, err := gm.dir.allValues(ctx, user, MEMBER_OF_TYPE)
+	if err != nil {
+		return err
+	}
+	member := false
+	for _, dn := range memberOf {
+		if dnKey(dn) == dnKey(grp.DN) {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return fmt.Errorf("user %v is not a member of %v", uid, groupName)
+	}
+
+	req := ldap.NewModifyRequest(user.DN, nil)
+	req.Replace(PRIMARY_GROUP_ID_TYPE, []string{strconv.FormatUint(uint64(rid), 10)})
+	return gm.dir.modify(ctx, req)
+}
@@ -0,0 +1,110 @@
+package cloudyad
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DOMAIN_SID_PREFIX is the prefix of the SIDs issued by a domain, as opposed
+// to the well known and builtin SIDs (e.g. S-1-5-32-544 for Administrators)
+const DOMAIN_SID_PREFIX = "S-1-5-21-"
+
+// DecodeSID converts the binary form of an objectSid into its string form,
+// e.g. S-1-5-21-3623811015-3361044348-30300820-1013
+func DecodeSID(b []byte) (string, error) {
+	if len(b) < 8 {
+		return "", fmt.Errorf("invalid SID, %d bytes", len(b))
+	}
+
+	revision := b[0]
+	count := int(b[1])
+	if len(b) != 8+4*count {
+		return "", fmt.Errorf("invalid SID, %d bytes for %d sub authorities", len(b), count)
+	}
+
+	// The authority is a 48 bit big endian value
+	var authority uint64
+	for _, v := range b[2:8] {
+		authority = authority<<8 | uint64(v)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("S-%d-%d", revision, authority))
+	for i := 0; i < count; i++ {
+		sb.WriteString(fmt.Sprintf("-%d", binary.LittleEndian.Uint32(b[8+4*i:])))
+	}
+	return sb.String(), nil
+}
+
+// EncodeSID converts the string form of a SID into its binary form
+func EncodeSID(sid string) ([]byte, error) {
+	parts := strings.Split(sid, "-")
+	if len(parts) < 3 || !strings.EqualFold(parts[0], "S") {
+		return nil, fmt.Errorf("invalid SID %v", sid)
+	}
+
+	revision, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SID %v", sid)
+	}
+	authority, err := strconv.ParseUint(parts[2], 10, 48)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SID %v", sid)
+	}
+
+	subs := parts[3:]
+	b := make([]byte, 8+4*len(subs))
+	b[0] = byte(revision)
+	b[1] = byte(len(subs))
+	for i := 7; i >= 2; i-- {
+		b[i] = byte(authority)
+		authority >>= 8
+	}
+	for i, s := range subs {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SID %v", sid)
+		}
+		binary.LittleEndian.PutUint32(b[8+4*i:], uint32(v))
+	}
+	return b, nil
+}
+
+// sidFilterValue escapes a SID for use in an LDAP filter on objectSid
+func sidFilterValue(sid string) (string, error) {
+	b, err := EncodeSID(sid)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, v := range b {
+		sb.WriteString(fmt.Sprintf("\\%02x", v))
+	}
+	return sb.String(), nil
+}
+
+// splitSID splits a SID into its domain part and the relative id (RID)
+func splitSID(sid string) (string, uint32, error) {
+	idx := strings.LastIndex(sid, "-")
+	if idx < 0 {
+		return "", 0, fmt.Errorf("invalid SID %v", sid)
+	}
+
+	rid, err := strconv.ParseUint(sid[idx+1:], 10, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid SID %v", sid)
+	}
+	return sid[:idx], uint32(rid), nil
+}
+
+// looksLikeSID reports if a value is the string form of a SID
+func looksLikeSID(val string) bool {
+	if len(val) < 4 || !strings.EqualFold(val[:4], "S-1-") {
+		return false
+	}
+	_, err := EncodeSID(val)
+	return err == nil
+}
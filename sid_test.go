@@ -0,0 +1,61 @@
+package cloudyad
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSIDCodec(t *testing.T) {
+	raw := []byte{
+		0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05,
+		0x15, 0x00, 0x00, 0x00,
+		0xc7, 0x82, 0xff, 0xd7,
+		0x7c, 0xd4, 0x55, 0xc8,
+		0x94, 0x5a, 0xce, 0x01,
+		0xf5, 0x03, 0x00, 0x00,
+	}
+
+	sid, err := DecodeSID(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, sid, "S-1-5-21-3623846599-3361068156-30300820-1013")
+
+	encoded, err := EncodeSID(sid)
+	assert.Nil(t, err)
+	assert.Equal(t, encoded, raw)
+
+	builtin, err := EncodeSID("S-1-5-32-544")
+	assert.Nil(t, err)
+	sid, err = DecodeSID(builtin)
+	assert.Nil(t, err)
+	assert.Equal(t, sid, "S-1-5-32-544")
+
+	_, err = DecodeSID(raw[:10])
+	assert.NotNil(t, err)
+
+	_, err = EncodeSID("X-1-5-21")
+	assert.NotNil(t, err)
+}
+
+func TestSIDFilterValue(t *testing.T) {
+	val, err := sidFilterValue("S-1-5-32-544")
+	assert.Nil(t, err)
+	assert.Equal(t, val, `\01\02\00\00\00\00\00\05\20\00\00\00\20\02\00\00`)
+}
+
+func TestSplitSID(t *testing.T) {
+	domain, rid, err := splitSID("S-1-5-21-3623781063-3361068156-30300820-513")
+	assert.Nil(t, err)
+	assert.Equal(t, domain, "S-1-5-21-3623781063-3361068156-30300820")
+	assert.Equal(t, rid, uint32(513))
+
+	_, _, err = splitSID("S-1-5-21-abc")
+	assert.NotNil(t, err)
+}
+
+func TestLooksLikeSID(t *testing.T) {
+	assert.True(t, looksLikeSID("S-1-5-21-3623781063-3361068156-30300820-513"))
+	assert.True(t, looksLikeSID("s-1-5-32-544"))
+	assert.False(t, looksLikeSID("S-1-abc"))
+	assert.False(t, looksLikeSID("svc-account"))
+}
@@ -0,0 +1,493 @@
+package cloudyad
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	CONFIG_NAMING_CONTEXT_TYPE = "configurationNamingContext"
+	ENABLED_FEATURE_TYPE       = "msDS-EnabledFeature"
+
+	PAM_FEATURE_RDN = "CN=Privileged Access Management Feature"
+)
+
+// MembershipGrant is a time-bound group membership
+type MembershipGrant struct {
+	Group   string    `json:"group"`
+	Member  string    `json:"member"`
+	Expires time.Time `json:"expires"`
+
+	// LinkTTL is set when AD expires the membership through a link TTL,
+	// these grants are never held in the ledger
+	LinkTTL bool `json:"linkTtl,omitempty"`
+}
+
+// GrantLedger stores the expiry of time-bound memberships. Grants are keyed
+// by group and member DN, putting a grant replaces any previous one.
+type GrantLedger interface {
+	Put(ctx context.Context, grant *MembershipGrant) error
+	Get(ctx context.Context, groupDN string, memberDN string) (*MembershipGrant, error)
+	Remove(ctx context.Context, groupDN string, memberDN string) error
+	List(ctx context.Context) ([]*MembershipGrant, error)
+}
+
+// fileGrantLedger keeps the grants in a JSON file, or only in memory when
+// there is no path. The file is read once and rewritten on every change
+// without locking, so only one process may use it.
+type fileGrantLedger struct {
+	path string
+
+	mu     sync.Mutex
+	loaded bool
+	grants map[string]*MembershipGrant
+}
+
+// NewGrantLedger creates a ledger stored in a JSON file used by one process,
+// or in memory when the path is empty. AddMembersFor does not record grants
+// in an in-memory ledger.
+func NewGrantLedger(path string) GrantLedger {
+	return &fileGrantLedger{
+		path:   path,
+		grants: make(map[string]*MembershipGrant),
+	}
+}
+
+// persistentLedger reports if grants outlive the process, which is true for
+// every ledger but the in-memory one
+func persistentLedger(ledger GrantLedger) bool {
+	l, ok := ledger.(*fileGrantLedger)
+	return !ok || l.path != ""
+}
+
+func grantKey(groupDN string, memberDN string) string {
+	return dnKey(groupDN) + "|" + dnKey(memberDN)
+}
+
+func (l *fileGrantLedger) Put(ctx context.Context, grant *MembershipGrant) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return err
+	}
+
+	copied := *grant
+	l.grants[grantKey(grant.Group, grant.Member)] = &copied
+	return l.save()
+}
+
+func (l *fileGrantLedger) Get(ctx context.Context, groupDN string, memberDN string) (*MembershipGrant, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	grant, ok := l.grants[grantKey(groupDN, memberDN)]
+	if !ok {
+		return nil, nil
+	}
+	copied := *grant
+	return &copied, nil
+}
+
+func (l *fileGrantLedger) Remove(ctx context.Context, groupDN string, memberDN string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return err
+	}
+
+	delete(l.grants, grantKey(groupDN, memberDN))
+	return l.save()
+}
+
+func (l *fileGrantLedger) List(ctx context.Context) ([]*MembershipGrant, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make([]*MembershipGrant, 0, len(l.grants))
+	for _, grant := range l.grants {
+		copied := *grant
+		grants = append(grants, &copied)
+	}
+	sortGrants(grants)
+	return grants, nil
+}
+
+func (l *fileGrantLedger) load() error {
+	if l.loaded || l.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		l.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var grants []*MembershipGrant
+	err = json.Unmarshal(data, &grants)
+	if err != nil {
+		return fmt.Errorf("invalid grant ledger %v: %v", l.path, err)
+	}
+	for _, grant := range grants {
+		l.grants[grantKey(grant.Group, grant.Member)] = grant
+	}
+	l.loaded = true
+	return nil
+}
+
+// save writes the ledger to a temporary file and renames it into place so a
+// failed write never leaves a truncated ledger behind
+func (l *fileGrantLedger) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	grants := make([]*MembershipGrant, 0, len(l.grants))
+	for _, grant := range l.grants {
+		grants = append(grants, grant)
+	}
+	sortGrants(grants)
+
+	data, err := json.MarshalIndent(grants, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+func sortGrants(grants []*MembershipGrant) {
+	sort.Slice(grants, func(i, j int) bool {
+		if !grants[i].Expires.Equal(grants[j].Expires) {
+			return grants[i].Expires.Before(grants[j].Expires)
+		}
+		return grantKey(grants[i].Group, grants[i].Member) < grantKey(grants[j].Group, grants[j].Member)
+	})
+}
+
+// SetGrantLedger replaces the ledger used for time-bound memberships, e.g.
+// with one kept in a shared database
+func (gm *AdGroupManager) SetGrantLedger(ledger GrantLedger) {
+	gm.ledger = ledger
+}
+
+// AddMembersFor adds members to a group for a limited time, using the link
+// TTLs of Privileged Access Management when the forest has them and the
+// persistent grant ledger and ReapExpiredGrants otherwise. Permanent members
+// stay permanent, a member that already has a grant gets the new expiry.
+func (gm *AdGroupManager) AddMembersFor(ctx context.Context, groupName string, members []string, ttl time.Duration) (*MembershipReport, error) {
+	if ttl < time.Second {
+		return nil, fmt.Errorf("invalid membership ttl %v", ttl)
+	}
+
+	linkTTL, err := gm.linkTTLEnabled(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if linkTTL {
+		return gm.changeMembers(ctx, groupName, members, true, ttl)
+	}
+	if !persistentLedger(gm.ledger) {
+		return nil, fmt.Errorf("time-bound memberships need link TTLs or a grant ledger file, set GrantLedgerFile")
+	}
+
+	report, err := gm.changeMembers(ctx, groupName, members, true, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(ttl).UTC()
+	for _, result := range report.Results {
+		switch result.Status {
+		case MEMBER_STATUS_ADDED:
+		case MEMBER_STATUS_PRESENT:
+			existing, err := gm.ledger.Get(ctx, report.Group, result.DN)
+			if err != nil {
+				return report, err
+			}
+			if existing == nil {
+				continue
+			}
+		default:
+			continue
+		}
+
+		err = gm.ledger.Put(ctx, &MembershipGrant{Group: report.Group, Member: result.DN, Expires: expires})
+		if err != nil {
+			return report, fmt.Errorf("%v was added to %v but the grant could not be recorded: %v", result.Member, groupName, err)
+		}
+	}
+	return report, nil
+}
+
+// dropGrants removes the ledger grants of the members a report added, removed
+// or found present or absent. A permanent add must not be undone by
+// ReapExpiredGrants and a removed member has nothing left to expire.
+func (gm *AdGroupManager) dropGrants(ctx context.Context, report *MembershipReport) error {
+	for _, result := range report.Results {
+		if result.Status == MEMBER_STATUS_NOT_FOUND || result.Status == MEMBER_STATUS_REJECTED {
+			continue
+		}
+		err := gm.ledger.Remove(ctx, report.Group, result.DN)
+		if err != nil {
+			return fmt.Errorf("the grant of %v in %v could not be dropped: %v", result.Member, report.Group, err)
+		}
+	}
+	return nil
+}
+
+// dropGroupGrants removes every ledger grant of a group
+func (gm *AdGroupManager) dropGroupGrants(ctx context.Context, groupDN string) error {
+	grants, err := gm.ledger.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		if dnKey(grant.Group) != dnKey(groupDN) {
+			continue
+		}
+		err = gm.ledger.Remove(ctx, grant.Group, grant.Member)
+		if err != nil {
+			return fmt.Errorf("the grant of %v in %v could not be dropped: %v", grant.Member, groupDN, err)
+		}
+	}
+	return nil
+}
+
+// ListGrants returns the active time-bound memberships of a group, both the
+// ones held in the ledger and, when enabled, the link TTLs. An empty group
+// name lists the ledger grants of all groups.
+func (gm *AdGroupManager) ListGrants(ctx context.Context, groupName string) ([]*MembershipGrant, error) {
+	groupDN := ""
+	if groupName != "" {
+		grp, err := gm.dir.groupEntry(ctx, groupName, []string{DN_TYPE})
+		if err != nil {
+			return nil, err
+		}
+		if grp == nil {
+			return nil, fmt.Errorf("group not found %v", groupName)
+		}
+		groupDN = grp.DN
+	}
+
+	all, err := gm.ledger.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var grants []*MembershipGrant
+	for _, grant := range all {
+		if grant.Expires.After(now) && (groupDN == "" || dnKey(grant.Group) == dnKey(groupDN)) {
+			grants = append(grants, grant)
+		}
+	}
+
+	if groupDN == "" {
+		return grants, nil
+	}
+
+	linkTTL, err := gm.linkTTLEnabled(ctx)
+	if err != nil || !linkTTL {
+		return grants, err
+	}
+
+	ttls, err := gm.dir.linkTTLMembers(ctx, groupDN)
+	if err != nil {
+		return nil, err
+	}
+	for dn, ttl := range ttls {
+		grants = append(grants, &MembershipGrant{Group: groupDN, Member: dn, Expires: now.Add(ttl).UTC(), LinkTTL: true})
+	}
+	sortGrants(grants)
+	return grants, nil
+}
+
+// ReapExpiredGrants removes the members whose ledger grants have expired,
+// returning a report per group. Grants are dropped from the ledger once the
+// member is gone, rejected removals are kept and retried on the next run.
+func (gm *AdGroupManager) ReapExpiredGrants(ctx context.Context) ([]*MembershipReport, error) {
+	all, err := gm.ledger.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	byGroup := make(map[string][]*MembershipGrant)
+	var groups []string
+	for _, grant := range all {
+		if grant.Expires.After(now) {
+			continue
+		}
+		key := dnKey(grant.Group)
+		if _, ok := byGroup[key]; !ok {
+			groups = append(groups, key)
+		}
+		byGroup[key] = append(byGroup[key], grant)
+	}
+
+	var reports []*MembershipReport
+	for _, key := range groups {
+		grants := byGroup[key]
+		report := &MembershipReport{Group: grants[0].Group}
+		for _, grant := range grants {
+			report.add(grant.Member, grant.Member, MEMBER_STATUS_REMOVED, nil)
+		}
+
+		gm.applyMemberChanges(ctx, report.Group, report.Results, false, 0)
+
+		for _, result := range report.Results {
+			if result.Status == MEMBER_STATUS_REJECTED {
+				continue
+			}
+			err = gm.ledger.Remove(ctx, report.Group, result.DN)
+			if err != nil {
+				return reports, err
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// linkTTLEnabled reports if the Privileged Access Management feature is
+// enabled in the forest. The answer is cached for the life of the manager.
+func (gm *AdGroupManager) linkTTLEnabled(ctx context.Context) (bool, error) {
+	gm.mu.Lock()
+	defer gm.mu.Unlock()
+
+	if gm.linkTTL != nil {
+		return *gm.linkTTL, nil
+	}
+
+	enabled, err := gm.dir.pamEnabled(ctx)
+	if err != nil {
+		return false, err
+	}
+	gm.linkTTL = &enabled
+	return enabled, nil
+}
+
+// pamEnabled looks for the Privileged Access Management feature in the
+// features enabled on the partitions container
+func (d *ldapDirectory) pamEnabled(ctx context.Context) (bool, error) {
+	root, err := d.entry(ctx, "", []string{CONFIG_NAMING_CONTEXT_TYPE})
+	if err != nil {
+		return false, err
+	}
+	if root == nil {
+		return false, nil
+	}
+
+	config := root.GetEqualFoldAttributeValue(CONFIG_NAMING_CONTEXT_TYPE)
+	if config == "" {
+		return false, nil
+	}
+
+	partitions, err := d.entry(ctx, "CN=Partitions,"+config, []string{ENABLED_FEATURE_TYPE})
+	if err != nil || partitions == nil {
+		return false, err
+	}
+
+	prefix := strings.ToLower(PAM_FEATURE_RDN + ",")
+	for _, feature := range partitions.GetEqualFoldAttributeValues(ENABLED_FEATURE_TYPE) {
+		if strings.HasPrefix(strings.ToLower(feature), prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// linkTTLMembers returns the members of a group that have a link TTL along
+// with the time they have left. Only the first range of a large group is
+// read as the TTL control does not combine with range retrieval.
+func (d *ldapDirectory) linkTTLMembers(ctx context.Context, groupDN string) (map[string]time.Duration, error) {
+	entry, err := d.entryWithControls(ctx, groupDN, []string{MEMBER_TYPE}, []ldap.Control{ldap.NewControlMicrosoftServerLinkTTL()})
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	members := make(map[string]time.Duration)
+	for _, val := range entry.GetEqualFoldAttributeValues(MEMBER_TYPE) {
+		dn, ttl, ok := parseLinkTTL(val)
+		if ok {
+			members[dn] = ttl
+		}
+	}
+	return members, nil
+}
+
+// linkValue returns the member value to write, with a link TTL prefix when
+// ttl is set, e.g. <TTL=3600,CN=user,DC=example,DC=com>
+func linkValue(dn string, ttl time.Duration) string {
+	if ttl <= 0 {
+		return dn
+	}
+	return fmt.Sprintf("<TTL=%d,%v>", int64(ttl/time.Second), dn)
+}
+
+// parseLinkTTL parses a member value read with the link TTL control, e.g.
+// <TTL=3599>,CN=user,DC=example,DC=com. Values without a TTL are permanent
+// and are not returned.
+func parseLinkTTL(val string) (string, time.Duration, bool) {
+	if !strings.HasPrefix(strings.ToUpper(val), "<TTL=") {
+		return "", 0, false
+	}
+
+	end := strings.Index(val, ">")
+	if end < 0 {
+		return "", 0, false
+	}
+
+	secs, err := strconv.ParseInt(val[len("<TTL="):end], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	dn := strings.TrimPrefix(val[end+1:], ",")
+	return dn, time.Duration(secs) * time.Second, true
+}
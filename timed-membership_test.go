@@ -0,0 +1,59 @@
+package cloudyad
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkValue(t *testing.T) {
+	assert.Equal(t, linkValue("CN=A,DC=test", 0), "CN=A,DC=test")
+	assert.Equal(t, linkValue("CN=A,DC=test", time.Hour), "<TTL=3600,CN=A,DC=test>")
+}
+
+func TestParseLinkTTL(t *testing.T) {
+	dn, ttl, ok := parseLinkTTL("<TTL=3599>,CN=A,DC=test")
+	assert.True(t, ok)
+	assert.Equal(t, dn, "CN=A,DC=test")
+	assert.Equal(t, ttl, 3599*time.Second)
+
+	_, _, ok = parseLinkTTL("CN=A,DC=test")
+	assert.False(t, ok)
+
+	_, _, ok = parseLinkTTL("<TTL=abc>,CN=A,DC=test")
+	assert.False(t, ok)
+}
+
+func TestFileGrantLedger(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "grants.json")
+
+	ledger := NewGrantLedger(path)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	assert.Nil(t, ledger.Put(ctx, &MembershipGrant{Group: "CN=G,DC=test", Member: "CN=A,DC=test", Expires: expires}))
+	assert.Nil(t, ledger.Put(ctx, &MembershipGrant{Group: "CN=G,DC=test", Member: "CN=B,DC=test", Expires: expires}))
+
+	reopened := NewGrantLedger(path)
+	grant, err := reopened.Get(ctx, "cn=g,dc=test", "cn=a,dc=test")
+	assert.Nil(t, err)
+	assert.NotNil(t, grant)
+	assert.True(t, grant.Expires.Equal(expires))
+
+	assert.Nil(t, reopened.Remove(ctx, "CN=G,DC=test", "CN=A,DC=test"))
+	grants, err := NewGrantLedger(path).List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 1)
+	assert.Equal(t, grants[0].Member, "CN=B,DC=test")
+
+	memory := NewGrantLedger("")
+	assert.Nil(t, memory.Put(ctx, &MembershipGrant{Group: "CN=G,DC=test", Member: "CN=A,DC=test", Expires: expires}))
+	grants, err = memory.List(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, len(grants), 1)
+
+	assert.True(t, persistentLedger(ledger))
+	assert.False(t, persistentLedger(memory))
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/appliedres/adc"
 	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy-ad/adtime"
 	"github.com/appliedres/cloudy/models"
 	"github.com/go-ldap/ldap/v3"
 	"golang.org/x/exp/maps"
@@ -46,12 +48,30 @@ type AdUserManagerConfig struct {
 	InsecureTLS     string
 	UserIdAttribute string
 	PageSize        int
+
+	// RenameOnIdChange renames the user object (CN) in UpdateUser when the
+	// value of the id attribute changes
+	RenameOnIdChange bool
+
+	// LastSignInMode is how IncludeLastSignIn works out the last sign in,
+	// LAST_SIGN_IN_MODE_REPLICATED (the default) or LAST_SIGN_IN_MODE_PRECISE.
+	// GetUserByEmail is the only lookup that takes UserOptions, other callers
+	// use GetLastSignIn.
+	LastSignInMode string
+
+	// BannedPasswordsFile is a banned password source new passwords are
+	// checked against, see LoadBannedPasswords
+	BannedPasswordsFile string
 }
 
 // USER MANAGER
 type AdUserManager struct {
-	cfg    AdUserManagerConfig
-	client *adc.Client
+	cfg AdUserManagerConfig
+	dir *ldapDirectory
+
+	mu           sync.Mutex
+	banned       BannedPasswords
+	bannedLoaded bool
 }
 
 func NewAdUserManager(cfg *AdUserManagerConfig) *AdUserManager {
@@ -76,34 +96,11 @@ func NewAdUserManager(cfg *AdUserManagerConfig) *AdUserManager {
 		cfg.PageSize = PAGE_SIZE
 	}
 
-	cl := adc.New(&adc.Config{
-		URL:         cfg.Address,
-		InsecureTLS: insecureTLS,
-		SearchBase:  cfg.Base,
-		Users: &adc.UsersConfigs{
-			SearchBase:  cfg.Base,
-			IdAttribute: cfg.UserIdAttribute,
-			Attributes:  USER_STANDARD_ATTRS,
-		},
-		Groups: &adc.GroupsConfigs{
-			SearchBase:  cfg.Base,
-			IdAttribute: cfg.UserIdAttribute,
-			Attributes:  GROUP_STANDARD_ATTRS,
-		},
-		Bind: &adc.BindAccount{
-			DN:       cfg.User,
-			Password: cfg.Pwd,
-		},
-	})
-
 	ad := &AdUserManager{
-		client: cl,
-		cfg:    *cfg,
+		cfg: *cfg,
+		dir: newLdapDirectory(cfg.Address, cfg.User, cfg.Pwd, insecureTLS, cfg.Base, cfg.UserIdAttribute, cfg.PageSize),
 	}
 
-	ad.client = cl
-	cl.Config.AppendUsesAttributes(DISPLAY_NAME_TYPE)
-
 	return ad
 }
 
@@ -113,40 +110,31 @@ func NewAdUserManagerFromEnv(ctx context.Context, env *cloudy.Environment) *AdUs
 		pageSize = PAGE_SIZE
 	}
 
+	renameOnIdChange, err := strconv.ParseBool(env.Default("AD_RENAME_ON_ID_CHANGE", "false"))
+	if err != nil {
+		renameOnIdChange = false
+	}
+
 	cfg := &AdUserManagerConfig{
-		Address:         env.Force("AD_HOST"),
-		User:            env.Force("AD_USER"),
-		Pwd:             env.Force("AD_PWD"),
-		Base:            env.Force("AD_BASE"),
-		GroupBase:       env.Force("AD_GROUP_BASE"),
-		UserBase:        env.Force("AD_USER_BASE"),
-		Domain:          env.Force("AD_DOMAIN"),
-		InsecureTLS:     env.Force("AD_INSECURE_TLS"),
-		UserIdAttribute: env.Force("AD_USER_ID_ATTRIBUTE"),
-		PageSize:        int(pageSize),
+		Address:             env.Force("AD_HOST"),
+		User:                env.Force("AD_USER"),
+		Pwd:                 env.Force("AD_PWD"),
+		Base:                env.Force("AD_BASE"),
+		GroupBase:           env.Force("AD_GROUP_BASE"),
+		UserBase:            env.Force("AD_USER_BASE"),
+		Domain:              env.Force("AD_DOMAIN"),
+		InsecureTLS:         env.Force("AD_INSECURE_TLS"),
+		UserIdAttribute:     env.Force("AD_USER_ID_ATTRIBUTE"),
+		PageSize:            int(pageSize),
+		RenameOnIdChange:    renameOnIdChange,
+		LastSignInMode:      env.Default("AD_LAST_SIGN_IN_MODE", LAST_SIGN_IN_MODE_REPLICATED),
+		BannedPasswordsFile: env.Default("AD_BANNED_PASSWORDS_FILE", ""),
 	}
 	return NewAdUserManager(cfg)
 }
 
 func (um *AdUserManager) connect(ctx context.Context) error {
-	_ = ctx
-	err := um.client.Connect()
-
-	return err
-}
-
-func (um *AdUserManager) reconnect(ctx context.Context) error {
-	err := um.client.Reconnect(ctx, TICKER_DURATION, MAX_ATTEMPTS)
-	return err
-}
-
-func (um *AdUserManager) connectAsNeeded(ctx context.Context) error {
-	var err error
-	if !um.client.ConnectedStatus() {
-		err = um.connect(ctx)
-	} else {
-		err = um.reconnect(ctx)
-	}
+	_, err := um.dir.connectAsNeeded(ctx)
 	return err
 }
 
@@ -165,117 +153,62 @@ func (um *AdUserManager) ForceUserName(ctx context.Context, name string) (string
 }
 
 func (um *AdUserManager) ListUsers(ctx context.Context, filter string, attrs []string) (*[]models.User, error) {
-	var args adc.GetUserArgs
-
-	err := um.connectAsNeeded(ctx)
+	entries, err := um.dir.search(ctx, um.dir.base, userFilter(filter), um.userAttributes(attrs))
 	if err != nil {
 		return nil, err
 	}
 
-	args.Attributes = append(attrs, USER_STANDARD_ATTRS...)
-	users, err := um.client.ListUsers(args, um.cfg.PageSize, filter)
-	if err != nil {
-		return nil, err
-	}
-	if users == nil {
-		return nil, nil
-	}
-
 	var results []models.User
-	for _, user := range *users {
-		results = append(results, *UserToCloudy(&user, nil))
+	for _, entry := range entries {
+		results = append(results, *entryToUser(entry, um.cfg.UserIdAttribute, nil))
 	}
 	return &results, nil
 }
 
 // Retrieves a specific user.
 func (um *AdUserManager) GetUser(ctx context.Context, uid string) (*models.User, error) {
-	err := um.connectAsNeeded(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	user, err := um.client.GetUser(adc.GetUserArgs{
-		Id: uid,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, nil
-	}
-
-	return UserToCloudy(user, nil), nil
+	return um.GetUserWithAttributes(ctx, uid, nil)
 }
 
 // not adding to Cloudy unless needed
 func (um *AdUserManager) GetUserByUserName(ctx context.Context, un string) (*models.User, error) {
-	err := um.connectAsNeeded(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	user, err := um.client.GetUser(adc.GetUserArgs{
-		Id: un,
-	})
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, nil
-	}
-
-	return UserToCloudy(user, nil), nil
+	return um.GetUserWithAttributes(ctx, un, nil)
 }
 
 func (um *AdUserManager) GetUserWithAttributes(ctx context.Context, uid string, attrs []string) (*models.User, error) {
-	err := um.connectAsNeeded(ctx)
-	if err != nil {
+	entry, err := um.dir.userEntry(ctx, uid, um.userAttributes(attrs))
+	if err != nil || entry == nil {
 		return nil, err
 	}
 
-	user, err := um.client.GetUser(adc.GetUserArgs{
-		Id:         uid,
-		Attributes: append(attrs, USER_STANDARD_ATTRS...),
-	})
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, nil
-	}
-
-	return UserToCloudy(user, nil), nil
+	return entryToUser(entry, um.cfg.UserIdAttribute, nil), nil
 }
 
 // Retrieves a specific user.
 func (um *AdUserManager) GetUserByEmail(ctx context.Context, email string, opts *cloudy.UserOptions) (*models.User, error) {
-	err := um.connectAsNeeded(ctx)
-	if err != nil {
+	entry, err := um.dir.findOne(ctx, userFilter(fmt.Sprintf("(%v=%v)", EMAIL_TYPE, ldap.EscapeFilter(email))), um.userAttributes(nil))
+	if err != nil || entry == nil {
 		return nil, err
 	}
 
-	user, err := um.client.GetUser(adc.GetUserArgs{
-		Filter: "(&(objectclass=person)(mail=" + email + "))",
-	})
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, nil
+	u := entryToUser(entry, um.cfg.UserIdAttribute, opts)
+	if includeLastSignIn(opts) && um.cfg.LastSignInMode == LAST_SIGN_IN_MODE_PRECISE {
+		// Keep the replicated value when no domain controller could be read
+		// but mark it as a fallback along with the reason
+		signIn, err := um.GetLastSignIn(ctx, u.UID, true)
+		if err != nil {
+			u.Attributes[LAST_SIGN_IN_PRECISION_TYPE] = LAST_SIGN_IN_PRECISION_FALLBACK
+			u.Attributes[LAST_SIGN_IN_ERROR_TYPE] = err.Error()
+		} else {
+			signIn.setAttributes(u.Attributes)
+		}
 	}
-
-	return UserToCloudy(user, opts), nil
+	return u, nil
 }
 
 // NewUser creates a new user with the given information and returns the new user with any additional
 // fields populated
 func (um *AdUserManager) NewUser(ctx context.Context, newUser *models.User) (*models.User, error) {
-	err := um.connectAsNeeded(ctx)
-	if err != nil {
-		return nil, err
-	}
-
 	if newUser.DisplayName == "" {
 		newUser.DisplayName = fmt.Sprintf("%v %v", newUser.FirstName, newUser.LastName)
 	}
@@ -291,7 +224,11 @@ func (um *AdUserManager) NewUser(ctx context.Context, newUser *models.User) (*mo
 	}
 
 	newUser.UID = newUser.Username
-	err = um.client.CreateUser(um.buildUserDN(newUser.UID), *cloudyToUserAttributes(newUser, fmt.Sprintf("%v.%v@%v", newUser.FirstName, newUser.LastName, um.cfg.Domain)))
+	req := ldap.NewAddRequest(um.buildUserDN(newUser.UID), nil)
+	for _, attr := range *cloudyToUserAttributes(newUser, fmt.Sprintf("%v.%v@%v", newUser.FirstName, newUser.LastName, um.cfg.Domain)) {
+		req.Attribute(attr.Type, attr.Vals)
+	}
+	err = um.dir.add(ctx, req)
 	if err != nil {
 		return nil, err
 	}
@@ -299,65 +236,112 @@ func (um *AdUserManager) NewUser(ctx context.Context, newUser *models.User) (*mo
 	return newUser, err
 }
 
+// SetUserPassword resets the password of a user and unlocks the account, see
+// SetUserPasswordWithOptions
 func (um *AdUserManager) SetUserPassword(ctx context.Context, usrId string, pwd string, mustChange bool) error {
-	return um.client.SetPassword(um.buildUserDN(usrId), pwd, mustChange)
+	return um.SetUserPasswordWithOptions(ctx, usrId, pwd, &SetPasswordOptions{MustChange: mustChange})
 }
 
+// UpdateUser writes the changed attributes of a user. With RenameOnIdChange a
+// changed id also renames the user, in one step that is undone when the
+// attributes can not be written.
 func (um *AdUserManager) UpdateUser(ctx context.Context, usr *models.User) error {
-	currentUser, err := um.GetUserWithAttributes(ctx, usr.UID, maps.Keys(usr.Attributes))
-	if err != nil || currentUser == nil {
+	entry, err := um.dir.userEntry(ctx, usr.UID, um.userAttributes(maps.Keys(usr.Attributes)))
+	if err != nil || entry == nil {
 		return err
 	}
+	currentUser := entryToUser(entry, um.cfg.UserIdAttribute, nil)
 
 	attrs := *cloudyToModifiedAttributes(usr, currentUser)
+	update := func(req *ldap.ModifyRequest) {
+		for _, attr := range attrs {
+			req.Replace(attr.Type, attr.Vals)
+		}
+	}
+
+	// The attribute changes go in the same modify as the rename so a failed
+	// update undoes the rename
+	newId := um.userIdValue(usr)
+	if um.cfg.RenameOnIdChange && newId != "" && newId != usr.UID {
+		_, err = um.dir.renameEntry(ctx, entry.DN, newId, update)
+		return err
+	}
+
 	if len(attrs) == 0 {
 		return nil
 	}
-
-	return um.client.UpdateUser(um.buildUserDN(usr.UID), attrs)
+	req := ldap.NewModifyRequest(entry.DN, nil)
+	update(req)
+	return um.dir.modify(ctx, req)
 }
 
-func (um *AdUserManager) Enable(ctx context.Context, uid string) error {
-	err := um.connectAsNeeded(ctx)
+// MoveUser moves a user into a different container or OU. The CN and all
+// attributes are left unchanged.
+func (um *AdUserManager) MoveUser(ctx context.Context, uid string, newParentDN string) error {
+	entry, err := um.dir.userEntry(ctx, uid, []string{USERNAME_TYPE})
 	if err != nil {
 		return err
 	}
-
-	userAccountControl := ldap.Attribute{
-		Type: USER_ACCOUNT_CONTROL_TYPE,
-		Vals: []string{fmt.Sprintf("%d", AC_NORMAL_ACCOUNT)},
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
 	}
 
-	return um.client.UpdateUser(um.buildUserDN(uid), []ldap.Attribute{userAccountControl})
+	_, err = um.dir.moveEntry(ctx, entry.DN, "", newParentDN)
+	return err
 }
 
-func (um *AdUserManager) Disable(ctx context.Context, uid string) error {
-	err := um.connectAsNeeded(ctx)
+// RenameUser changes the CN of a user. AD derives name and cn from the new
+// RDN, sAMAccountName (and the id attribute when that is displayName) are
+// updated to match so lookups keep working. The rename is undone when they
+// can not be updated.
+func (um *AdUserManager) RenameUser(ctx context.Context, uid string, newName string) error {
+	entry, err := um.dir.userEntry(ctx, uid, []string{USERNAME_TYPE})
 	if err != nil {
 		return err
 	}
-
-	userAccountControl := ldap.Attribute{
-		Type: USER_ACCOUNT_CONTROL_TYPE,
-		Vals: []string{fmt.Sprintf("%d", AC_NORMAL_ACCOUNT|AC_ACCOUNTDISABLE)},
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
 	}
 
-	return um.client.UpdateUser(um.buildUserDN(uid), []ldap.Attribute{userAccountControl})
+	_, err = um.dir.renameEntry(ctx, entry.DN, newName, func(req *ldap.ModifyRequest) {
+		if um.cfg.UserIdAttribute == DISPLAY_NAME_TYPE {
+			req.Replace(DISPLAY_NAME_TYPE, []string{newName})
+		}
+	})
+	return err
+}
+
+// Enable clears the disabled flag, the other userAccountControl flags are
+// left as they are
+func (um *AdUserManager) Enable(ctx context.Context, uid string) error {
+	return um.updateAccountControl(ctx, uid, func(uac uint32) uint32 {
+		return uac &^ AC_ACCOUNTDISABLE
+	})
+}
+
+// Disable sets the disabled flag, the other userAccountControl flags are
+// left as they are
+func (um *AdUserManager) Disable(ctx context.Context, uid string) error {
+	return um.updateAccountControl(ctx, uid, func(uac uint32) uint32 {
+		return uac | AC_ACCOUNTDISABLE
+	})
 }
 
 func (um *AdUserManager) DeleteUser(ctx context.Context, uid string) error {
-	err := um.connectAsNeeded(ctx)
+	entry, err := um.dir.userEntry(ctx, uid, []string{DN_TYPE})
 	if err != nil {
 		return err
 	}
+	if entry == nil {
+		return fmt.Errorf("user not found %v", uid)
+	}
 
-	return um.client.DeleteUser(um.buildUserDN(uid))
+	return um.dir.del(ctx, entry.DN)
 }
 
 func UserToCloudy(user *adc.User, opts *cloudy.UserOptions) *models.User {
 	uac, _ := strconv.Atoi(user.GetStringAttribute(USER_ACCOUNT_CONTROL_TYPE))
 	enabled := (uac & AC_ACCOUNTDISABLE) == 0
-	// locked := (uac & AC_LOCKOUT) == 0
 	u := &models.User{
 		UID:         user.Id,
 		Username:    user.Id,
@@ -377,20 +361,81 @@ func UserToCloudy(user *adc.User, opts *cloudy.UserOptions) *models.User {
 		}
 	}
 
-	if opts != nil && *opts.IncludeLastSignIn {
-		var lastLogon int64
-		lastLogon, err := strconv.ParseInt(user.GetStringAttribute(LAST_LOGIN_TYPE), 10, 64)
-		if err == nil {
+	if user.GetStringAttribute(USER_ACCOUNT_CONTROL_TYPE) != "" {
+		computed, _ := strconv.Atoi(user.GetStringAttribute(UAC_COMPUTED_TYPE))
+		if u.Attributes == nil {
 			u.Attributes = make(map[string]string)
-			// Windows NT time format to linux time
-			u.Attributes[LAST_LOGIN_TYPE] = time.Unix((lastLogon/10000000)-11644473600, 0).String()
 		}
+		u.Attributes[ACCOUNT_FLAGS_TYPE] = (UserAccountControl(uac) | UserAccountControl(computed)).String()
+		u.Attributes[LOCKED_OUT_TYPE] = strconv.FormatBool(lockedOut(user.GetStringAttribute(UAC_COMPUTED_TYPE), user.GetStringAttribute(LOCKOUT_TIME_TYPE)))
 	}
+
+	if includeLastSignIn(opts) {
+		if u.Attributes == nil {
+			u.Attributes = make(map[string]string)
+		}
+		lastSignInFromTimestamp(user.GetStringAttribute(LAST_LOGON_TIMESTAMP_TYPE)).setAttributes(u.Attributes)
+	}
+
+	timeAttributesToCloudy(u.Attributes)
 	return u
 }
 
+// timeAttributesToCloudy replaces the file time and generalized time values
+// with RFC 3339 times, or an empty string for the not set and never values.
+// A pwdLastSet of 0 means the password has to be changed at the next sign in.
+func timeAttributesToCloudy(attrs map[string]string) {
+	for k, v := range attrs {
+		var t time.Time
+		var err error
+		switch {
+		case inAttrList(k, FILE_TIME_ATTRS):
+			t, err = adtime.ParseFileTime(v)
+		case inAttrList(k, GENERALIZED_TIME_ATTRS):
+			t, err = adtime.ParseGeneralizedTime(v)
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if strings.EqualFold(k, PASSWORD_LAST_SET) {
+			attrs[PASSWORD_MUST_CHANGE_TYPE] = strconv.FormatBool(strings.TrimSpace(v) == "0")
+		}
+		attrs[k] = adtime.Format(t)
+	}
+}
+
+// entryToUser converts a raw directory entry into a user
+func entryToUser(entry *ldap.Entry, idAttribute string, opts *cloudy.UserOptions) *models.User {
+	return UserToCloudy(&adc.User{
+		Id:         entry.GetEqualFoldAttributeValue(idAttribute),
+		Attributes: entryAttributes(entry, OBJ_CLASS_TYPE, MEMBER_OF_TYPE),
+	}, opts)
+}
+
+// buildUserDN returns the DN a new user is created with, existing users are
+// looked up as they may have been moved
 func (um *AdUserManager) buildUserDN(username string) string {
-	return fmt.Sprintf("CN=%v,%v", username, um.cfg.UserBase)
+	return fmt.Sprintf("%v,%v", commonNameRDN(username), um.cfg.UserBase)
+}
+
+// userAttributes returns the attributes to read for a user, the standard
+// ones and the id attribute along with the given ones
+func (um *AdUserManager) userAttributes(attrs []string) []string {
+	return append(append([]string{um.cfg.UserIdAttribute}, attrs...), USER_STANDARD_ATTRS...)
+}
+
+// userIdValue returns the value the id attribute would have for the given user
+func (um *AdUserManager) userIdValue(usr *models.User) string {
+	switch um.cfg.UserIdAttribute {
+	case DISPLAY_NAME_TYPE:
+		return usr.DisplayName
+	case USERNAME_TYPE, SAM_ACCT_NAME_TYPE:
+		return usr.Username
+	}
+	return ""
 }
 
 func (um *AdUserManager) createUserName(usr *models.User) string {
@@ -450,13 +495,19 @@ func cloudyToUserAttributes(usr *models.User, upn string) *[]ldap.Attribute {
 		Type: USER_ACCOUNT_CONTROL_TYPE,
 		Vals: []string{fmt.Sprintf("%d", AC_NORMAL_ACCOUNT|AC_ACCOUNTDISABLE)},
 	})
+
+	// accountExpires is given the same way it is returned, an RFC 3339 time
+	expires := fmt.Sprintf("%d", AC_ACCOUNT_NEVER_EXPIRES)
+	if t, err := time.Parse(time.RFC3339, usr.Attributes[ACCT_EXPIRES_TYPE]); err == nil {
+		expires = adtime.FormatFileTime(t)
+	}
 	attrs = append(attrs, ldap.Attribute{
 		Type: ACCT_EXPIRES_TYPE,
-		Vals: []string{fmt.Sprintf("%d", AC_ACCOUNT_NEVER_EXPIRES)},
+		Vals: []string{expires},
 	})
 
 	for k, v := range usr.Attributes {
-		if v == "" {
+		if v == "" || isComputedUserAttr(k) {
 			continue
 		}
 
@@ -501,7 +552,7 @@ func cloudyToModifiedAttributes(updateReqUser *models.User, currentUser *models.
 	}
 
 	for k, v := range updateReqUser.Attributes {
-		if v == "" {
+		if v == "" || isComputedUserAttr(k) {
 			continue
 		}
 		if currentUser.Attributes[k] == "" || currentUser.Attributes[k] != v {
@@ -514,6 +565,19 @@ func cloudyToModifiedAttributes(updateReqUser *models.User, currentUser *models.
 	return &attrs
 }
 
+func isComputedUserAttr(key string) bool {
+	return inAttrList(key, USER_COMPUTED_ATTRS)
+}
+
+func inAttrList(key string, list []string) bool {
+	for _, v := range list {
+		if strings.EqualFold(key, v) {
+			return true
+		}
+	}
+	return false
+}
+
 func inObjAttrs(key string) bool {
 	for _, v := range USER_OBJECT_ATTRS {
 		if key == v {
@@ -2,6 +2,8 @@ package cloudyad
 
 import (
 	"context"
+	"errors"
+	"strconv"
 	"testing"
 	"time"
 
@@ -83,7 +85,8 @@ func TestCloudyADUserMgr(t *testing.T) {
 	assert.NotNil(t, user)
 	assert.Equal(t, user.FirstName, "jane2")
 	assert.Equal(t, user.Attributes["telephoneNumber"], "800-555-1212")
-	assert.Equal(t, user.Attributes[PASSWORD_LAST_SET], "0")
+	assert.Equal(t, user.Attributes[PASSWORD_LAST_SET], "")
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "true")
 
 	err = ad.Disable(ctx, newUsr.UID)
 	assert.Nil(t, err)
@@ -104,3 +107,521 @@ func TestCloudyADUserMgr(t *testing.T) {
 	assert.Nil(t, err)
 
 }
+
+func TestMoveRenameUser(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "John Roe",
+		FirstName:   "John",
+		LastName:    "Roe",
+		Email:       "john.roe@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	err = ad.RenameUser(ctx, newUsr.UID, "Johnny Roe")
+	assert.Nil(t, err)
+
+	user, err := ad.GetUserWithAttributes(ctx, "Johnny Roe", []string{SAM_ACCT_NAME_TYPE, NAME_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+	assert.Equal(t, user.Attributes[SAM_ACCT_NAME_TYPE], "Johnny Roe")
+	assert.Equal(t, user.Attributes[NAME_TYPE], "Johnny Roe")
+
+	err = ad.MoveUser(ctx, "Johnny Roe", "CN=Users,"+ad.cfg.Base)
+	assert.Nil(t, err)
+
+	entry, err := ad.dir.userEntry(ctx, "Johnny Roe", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.DN, "CN=Johnny Roe,CN=Users,"+ad.cfg.Base)
+
+	// The moved user is updated, renamed and deleted where it is
+	ad.cfg.RenameOnIdChange = true
+
+	// A rejected attribute undoes the rename
+	err = ad.UpdateUser(ctx, &models.User{
+		UID:         "Johnny Roe",
+		Username:    "Johnny Roe",
+		FirstName:   "John",
+		LastName:    "Roe",
+		DisplayName: "Jon Roe",
+		Email:       "john.roe@us.af.mil",
+		Attributes:  map[string]string{"noSuchAttribute": "value"},
+	})
+	assert.NotNil(t, err)
+
+	entry, err = ad.dir.userEntry(ctx, "Johnny Roe", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.DN, "CN=Johnny Roe,CN=Users,"+ad.cfg.Base)
+	user = &models.User{
+		UID:         "Johnny Roe",
+		Username:    "Johnny Roe",
+		FirstName:   "John",
+		LastName:    "Roe",
+		DisplayName: "Jon Roe",
+		Email:       "john.roe@us.af.mil",
+	}
+	err = ad.UpdateUser(ctx, user)
+	assert.Nil(t, err)
+
+	user, err = ad.GetUser(ctx, "Jon Roe")
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+
+	entry, err = ad.dir.userEntry(ctx, "Jon Roe", nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	assert.Equal(t, entry.DN, "CN=Jon Roe,CN=Users,"+ad.cfg.Base)
+
+	err = ad.DeleteUser(ctx, "Jon Roe")
+	assert.Nil(t, err)
+}
+
+func TestEnableDisablePreservesFlags(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Flag Keeper",
+		FirstName:   "Flag",
+		LastName:    "Keeper",
+		Email:       "flag.keeper@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	err = ad.updateAccountControl(ctx, newUsr.UID, func(uac uint32) uint32 {
+		return uac | AC_DONT_EXPIRE_PASSWORD
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, ad.Enable(ctx, newUsr.UID))
+	assert.Nil(t, ad.Disable(ctx, newUsr.UID))
+
+	entry, err := ad.dir.userEntry(ctx, newUsr.UID, []string{USER_ACCOUNT_CONTROL_TYPE})
+	assert.Nil(t, err)
+	assert.NotNil(t, entry)
+	uac, err := strconv.ParseInt(entry.GetEqualFoldAttributeValue(USER_ACCOUNT_CONTROL_TYPE), 10, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, uac&AC_DONT_EXPIRE_PASSWORD, int64(AC_DONT_EXPIRE_PASSWORD))
+	assert.Equal(t, uac&AC_ACCOUNTDISABLE, int64(AC_ACCOUNTDISABLE))
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestAccountFlags(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Flag Setter",
+		FirstName:   "Flag",
+		LastName:    "Setter",
+		Email:       "flag.setter@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	err = ad.SetAccountFlags(ctx, newUsr.UID, AccountPasswordNeverExpires|AccountNotDelegated)
+	assert.Nil(t, err)
+
+	flags, err := ad.GetAccountFlags(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.True(t, flags.PasswordNeverExpires())
+	assert.True(t, flags.NotDelegated())
+	assert.True(t, flags.Has(AccountNormal))
+
+	user, err := ad.GetUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[ACCOUNT_FLAGS_TYPE], flags.String())
+
+	err = ad.ClearAccountFlags(ctx, newUsr.UID, AccountNotDelegated)
+	assert.Nil(t, err)
+
+	flags, err = ad.GetAccountFlags(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.True(t, flags.PasswordNeverExpires())
+	assert.False(t, flags.NotDelegated())
+
+	err = ad.SetAccountFlags(ctx, newUsr.UID, AccountLockedOut)
+	assert.NotNil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestLockoutStatus(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Lock Smith",
+		FirstName:   "Lock",
+		LastName:    "Smith",
+		Email:       "lock.smith@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	status, err := ad.GetLockoutStatus(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.False(t, status.Locked)
+	assert.True(t, status.LockoutTime.IsZero())
+
+	err = ad.UnlockUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+
+	user, err := ad.GetUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[LOCKED_OUT_TYPE], "false")
+
+	_, err = ad.GetLockoutStatus(ctx, "nosuchuser")
+	assert.NotNil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestAccountExpiry(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Temp Contractor",
+		FirstName:   "Temp",
+		LastName:    "Contractor",
+		Email:       "temp.contractor@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	user, err := ad.GetUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[ACCT_EXPIRES_TYPE], "")
+
+	expires := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	err = ad.SetAccountExpiry(ctx, newUsr.UID, expires)
+	assert.Nil(t, err)
+
+	user, err = ad.GetUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[ACCT_EXPIRES_TYPE], expires.Format(time.RFC3339))
+
+	expiring, err := ad.ListExpiringUsers(ctx, 72*time.Hour)
+	assert.Nil(t, err)
+	assert.NotNil(t, expiring)
+	found := false
+	for _, u := range *expiring {
+		if u.UID == newUsr.UID {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	err = ad.ClearAccountExpiry(ctx, newUsr.UID)
+	assert.Nil(t, err)
+
+	user, err = ad.GetUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[ACCT_EXPIRES_TYPE], "")
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestTimeAttributesToCloudy(t *testing.T) {
+	attrs := map[string]string{
+		PASSWORD_LAST_SET:         "133000000000000000",
+		ACCT_EXPIRES_TYPE:         "9223372036854775807",
+		LAST_LOGON_TIMESTAMP_TYPE: "0",
+		"WhenCreated":             "20220618042640.0Z",
+		"telephoneNumber":         "800-555-1212",
+		LOCKOUT_TIME_TYPE:         "not a time",
+	}
+	timeAttributesToCloudy(attrs)
+
+	assert.Equal(t, attrs[PASSWORD_LAST_SET], "2022-06-18T04:26:40Z")
+	assert.Equal(t, attrs[PASSWORD_MUST_CHANGE_TYPE], "false")
+	assert.Equal(t, attrs[ACCT_EXPIRES_TYPE], "")
+	assert.Equal(t, attrs[LAST_LOGON_TIMESTAMP_TYPE], "")
+	assert.Equal(t, attrs["WhenCreated"], "2022-06-18T04:26:40Z")
+	assert.Equal(t, attrs["telephoneNumber"], "800-555-1212")
+	assert.Equal(t, attrs[LOCKOUT_TIME_TYPE], "not a time")
+}
+
+func TestLastSignIn(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Sign In",
+		FirstName:   "Sign",
+		LastName:    "In",
+		Email:       "sign.in@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	user, err := ad.GetUserByEmail(ctx, "sign.in@us.af.mil", &cloudy.UserOptions{IncludeLastSignIn: cloudy.BoolP(true)})
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+	assert.Equal(t, user.Attributes[LAST_SIGN_IN_TYPE], "")
+	assert.Equal(t, user.Attributes[LAST_SIGN_IN_SOURCE_TYPE], LAST_LOGON_TIMESTAMP_TYPE)
+	assert.Equal(t, user.Attributes[LAST_SIGN_IN_PRECISION_TYPE], LAST_SIGN_IN_PRECISION_APPROXIMATE)
+
+	signIn, err := ad.GetLastSignIn(ctx, newUsr.UID, false)
+	assert.Nil(t, err)
+	assert.Equal(t, signIn.Source, LAST_LOGON_TIMESTAMP_TYPE)
+	assert.True(t, signIn.Time.IsZero())
+
+	_, err = ad.GetLastSignIn(ctx, "nosuchuser", false)
+	assert.NotNil(t, err)
+
+	dcs, err := ad.dir.domainControllers(ctx)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, dcs)
+
+	ad.cfg.LastSignInMode = LAST_SIGN_IN_MODE_PRECISE
+	user, err = ad.GetUserByEmail(ctx, "sign.in@us.af.mil", &cloudy.UserOptions{IncludeLastSignIn: cloudy.BoolP(true)})
+	assert.Nil(t, err)
+	assert.NotNil(t, user)
+
+	// The container advertises a host name that may not resolve from the
+	// test, the precise mode then falls back and says so
+	signIn, err = ad.GetLastSignIn(ctx, newUsr.UID, true)
+	if err != nil {
+		assert.Equal(t, user.Attributes[LAST_SIGN_IN_PRECISION_TYPE], LAST_SIGN_IN_PRECISION_FALLBACK)
+		assert.NotEmpty(t, user.Attributes[LAST_SIGN_IN_ERROR_TYPE])
+		assert.Nil(t, ad.DeleteUser(ctx, newUsr.UID))
+		t.Skipf("domain controllers can not be read: %v", err)
+	}
+
+	assert.Equal(t, signIn.Source, LAST_LOGIN_TYPE)
+	assert.Equal(t, signIn.Precision, LAST_SIGN_IN_PRECISION_EXACT)
+	assert.NotEmpty(t, signIn.DomainControllers)
+	assert.True(t, signIn.Time.IsZero())
+	assert.Equal(t, user.Attributes[LAST_SIGN_IN_SOURCE_TYPE], LAST_LOGIN_TYPE)
+	assert.Equal(t, user.Attributes[LAST_SIGN_IN_PRECISION_TYPE], LAST_SIGN_IN_PRECISION_EXACT)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestChangeUserPassword(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Self Service",
+		FirstName:   "Self",
+		LastName:    "Service",
+		Email:       "self.service@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	// Must change skips the minimum password age for the change below
+	err = ad.SetUserPassword(ctx, newUsr.UID, "W!SjA-as44", true)
+	assert.Nil(t, err)
+
+	var pwdErr *PasswordError
+	err = ad.ChangeUserPassword(ctx, newUsr.UID, "wrong-Pa55", "Q7!rTz-wx81")
+	assert.True(t, errors.As(err, &pwdErr))
+
+	err = ad.ChangeUserPassword(ctx, newUsr.UID, "W!SjA-as44", "a")
+	assert.True(t, errors.As(err, &pwdErr))
+	assert.Equal(t, pwdErr.Code, uint32(ERROR_PASSWORD_RESTRICTION))
+
+	err = ad.ChangeUserPassword(ctx, newUsr.UID, "W!SjA-as44", "Q7!rTz-wx81")
+	assert.Nil(t, err)
+
+	err = ad.ChangeUserPassword(ctx, "nosuchuser", "W!SjA-as44", "Q7!rTz-wx81")
+	assert.NotNil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestSetUserPasswordWithOptions(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Reset Me",
+		FirstName:   "Reset",
+		LastName:    "Me",
+		Email:       "reset.me@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	err = ad.Disable(ctx, newUsr.UID)
+	assert.Nil(t, err)
+
+	err = ad.SetUserPasswordWithOptions(ctx, newUsr.UID, "W!SjA-as44", &SetPasswordOptions{MustChange: true, Enable: true})
+	assert.Nil(t, err)
+
+	user, err := ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Enabled, true)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "true")
+
+	err = ad.ResetPasswordClock(ctx, newUsr.UID)
+	assert.Nil(t, err)
+
+	user, err = ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "false")
+	assert.NotEqual(t, user.Attributes[PASSWORD_LAST_SET], "")
+
+	err = ad.ExpirePassword(ctx, newUsr.UID)
+	assert.Nil(t, err)
+
+	user, err = ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "true")
+
+	err = ad.SetUserPasswordWithOptions(ctx, newUsr.UID, "W!SjA-as45", &SetPasswordOptions{ClearMustChange: true})
+	assert.Nil(t, err)
+
+	user, err = ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "false")
+
+	err = ad.SetUserPasswordWithOptions(ctx, newUsr.UID, "W!SjA-as46", &SetPasswordOptions{ExpireNow: true})
+	assert.Nil(t, err)
+
+	user, err = ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "true")
+
+	err = ad.SetUserPasswordWithOptions(ctx, newUsr.UID, "W!SjA-as47", &SetPasswordOptions{ClearMustChange: true, ExpireNow: true})
+	assert.NotNil(t, err)
+
+	err = ad.SetUserPassword(ctx, "nosuchuser", "W!SjA-as44", false)
+	assert.NotNil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	policy, err := ad.GetPasswordPolicy(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, policy)
+	assert.False(t, policy.FineGrained)
+	assert.True(t, policy.MinLength > 0)
+
+	usr := &models.User{
+		DisplayName: "Policy Reader",
+		FirstName:   "Policy",
+		LastName:    "Reader",
+		Email:       "policy.reader@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	// Without a password settings object the domain policy applies
+	userPolicy, err := ad.GetUserPasswordPolicy(ctx, newUsr.UID)
+	assert.Nil(t, err)
+	assert.Equal(t, userPolicy, policy)
+
+	_, err = ad.GetUserPasswordPolicy(ctx, "nosuchuser")
+	assert.NotNil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestValidatePassword(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	usr := &models.User{
+		DisplayName: "Vera Validate",
+		FirstName:   "Vera",
+		LastName:    "Validate",
+		Email:       "vera.validate@us.af.mil",
+	}
+	newUsr, err := ad.NewUser(ctx, usr)
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+
+	err = ad.ValidatePassword(ctx, newUsr.UID, "W!SjA-as44")
+	assert.Nil(t, err)
+
+	var pwdErr *PasswordError
+	err = ad.ValidatePassword(ctx, newUsr.UID, "Validate1!")
+	assert.True(t, errors.As(err, &pwdErr))
+	assert.NotEmpty(t, pwdErr.Violations)
+
+	err = ad.ValidatePassword(ctx, newUsr.UID, "abc")
+	assert.True(t, errors.As(err, &pwdErr))
+
+	// AD rejects what ValidatePassword rejects
+	err = ad.SetUserPassword(ctx, newUsr.UID, "abc", false)
+	assert.True(t, errors.As(err, &pwdErr))
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}
+
+func TestNewUserWithPassword(t *testing.T) {
+	ad, ctx, err := initUserManager()
+	assert.Nil(t, err)
+	assert.NotNil(t, ad)
+
+	pwd, err := ad.GeneratePassword(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(pwd), DEFAULT_PASSWORD_LENGTH)
+
+	usr := &models.User{
+		DisplayName: "Gene Rated",
+		FirstName:   "Gene",
+		LastName:    "Rated",
+		Email:       "gene.rated@us.af.mil",
+	}
+	newUsr, pwd, err := ad.NewUserWithPassword(ctx, usr, &GeneratePasswordOptions{Passphrase: true}, &SetPasswordOptions{MustChange: true, Enable: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, newUsr)
+	assert.NotEqual(t, pwd, "")
+
+	user, err := ad.GetUserWithAttributes(ctx, newUsr.UID, []string{PASSWORD_LAST_SET})
+	assert.Nil(t, err)
+	assert.Equal(t, user.Enabled, true)
+	assert.Equal(t, user.Attributes[PASSWORD_MUST_CHANGE_TYPE], "true")
+
+	// The generated password is the one that was set
+	err = ad.ChangeUserPassword(ctx, newUsr.UID, pwd, "Q7!rTz-wx81")
+	assert.Nil(t, err)
+
+	err = ad.DeleteUser(ctx, newUsr.UID)
+	assert.Nil(t, err)
+}